@@ -10,6 +10,10 @@ type Api struct {
 	Host            string        `default:"0.0.0.0"`
 	Port            string        `default:"8080"`
 	GracefulTimeout time.Duration `default:"30s"`
+	// Token is the bearer token of the routes gateways and operators use
+	// to change shared state (/events, /usage, /denylist and /clear), which
+	// are disabled without it.
+	Token string
 }
 
 type Database struct {
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// CORS is the CORS policy gateways apply to a project's JSON-RPC and LCD
+// responses, stored as jsonb. The allowed origins are the project's origins.
+type CORS struct {
+	AllowHeaders     []string `json:"allow_headers" validate:"dive,required"`
+	ExposeHeaders    []string `json:"expose_headers" validate:"dive,required"`
+	MaxAge           int      `json:"max_age" validate:"gte=0,lte=86400"`
+	AllowCredentials bool     `json:"allow_credentials"`
+}
+
+func (c CORS) Value() (driver.Value, error) {
+	return json.Marshal(c)
+}
+
+func (c *CORS) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	}
+	return errors.New("cors: unsupported type")
+}
+
+// UpdateCORS replaces the CORS policy of a project.
+func (h *Handler) UpdateCORS(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+	cors := CORS{}
+	if err := render.Decode(r, &cors); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	if err := h.validate.Struct(cors); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE projects SET cors=$1 WHERE id=$2", cors, projectID)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish("", projectID)
+	render.Respond(w, r, NewResponse(http.StatusOK, cors, nil))
+}
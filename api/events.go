@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	eventsPollInterval = time.Second
+	eventsKeepAlive    = 15 * time.Second
+	eventsRetention    = 24 * time.Hour
+	eventsBuffer       = 64
+	// eventsOverlap is how long events are polled again after being
+	// created: ids are taken when inserting, so a replica may commit an
+	// event after others committed higher ids.
+	eventsOverlap = time.Minute
+)
+
+// RouteEvent tells that the routes of a chain and/or a project have changed.
+// An empty chain or project matches any.
+type RouteEvent struct {
+	ID         int64     `json:"id" db:"id"`
+	Chain      string    `json:"chain" db:"chain"`
+	Project    string    `json:"project" db:"project"`
+	CreateTime time.Time `json:"-" db:"create_time"`
+}
+
+// Events polls the route events every API replica publishes to the database
+// and fans them out to the local route cache and to subscribed gateways.
+type Events struct {
+	db    *sqlx.DB
+	evict func(RouteEvent)
+
+	mu          sync.Mutex
+	lastID      int64
+	seen        map[int64]time.Time // ids polled within the overlap
+	subscribers map[chan RouteEvent]struct{}
+	done        chan struct{}
+}
+
+func NewEvents(db *sqlx.DB) *Events {
+	return &Events{
+		db:          db,
+		evict:       func(RouteEvent) {},
+		seen:        make(map[int64]time.Time),
+		subscribers: make(map[chan RouteEvent]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Run polls for new events until Close.
+func (e *Events) Run() {
+	if err := e.db.Get(&e.lastID, "SELECT COALESCE(MAX(id), 0) FROM route_events"); err != nil {
+		log.Println("events:", err)
+	}
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+	cleanup := time.Now()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+		if err := e.poll(); err != nil {
+			log.Println("events:", err)
+		}
+		if time.Since(cleanup) > time.Hour {
+			cleanup = time.Now()
+			if _, err := e.db.Exec("DELETE FROM route_events WHERE create_time < $1", cleanup.Add(-eventsRetention)); err != nil {
+				log.Println("events:", err)
+			}
+		}
+	}
+}
+
+func (e *Events) poll() error {
+	events := []RouteEvent{}
+	err := e.db.Select(&events, `SELECT * FROM route_events
+		WHERE id > $1 OR create_time > now() - $2 * interval '1 second' ORDER BY id`,
+		e.last(), eventsOverlap.Seconds())
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, event := range events {
+		if _, ok := e.seen[event.ID]; ok {
+			continue
+		}
+		e.seen[event.ID] = time.Now()
+		e.evict(event)
+		for ch := range e.subscribers {
+			select {
+			case ch <- event:
+			default:
+				// Too slow, the gateway reconnects and replays from its
+				// last event.
+				delete(e.subscribers, ch)
+				close(ch)
+			}
+		}
+		if event.ID > e.lastID {
+			e.lastID = event.ID
+		}
+	}
+	for id, polled := range e.seen {
+		if time.Since(polled) > 2*eventsOverlap {
+			delete(e.seen, id)
+		}
+	}
+	return nil
+}
+
+func (e *Events) last() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastID
+}
+
+// Close ends the polling and every subscription.
+func (e *Events) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+	close(e.done)
+	for ch := range e.subscribers {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
+
+// subscribe returns the events after the last polled one, and the id of
+// that event.
+func (e *Events) subscribe() (chan RouteEvent, int64) {
+	ch := make(chan RouteEvent, eventsBuffer)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.done:
+		close(ch)
+	default:
+		e.subscribers[ch] = struct{}{}
+	}
+	return ch, e.lastID
+}
+
+func (e *Events) unsubscribe(ch chan RouteEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.subscribers[ch]; ok {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish records a change to the routes of a chain and/or a project. Local
+// routes are evicted right away, other replicas and the gateways follow
+// within a poll interval.
+func (h *Handler) publish(chain, project string) {
+	event := RouteEvent{Chain: chain, Project: project}
+	h.evictRoutes(event)
+	if _, err := h.db.NamedExec("INSERT INTO route_events (chain,project) VALUES (:chain,:project)", event); err != nil {
+		// Gateways still pick the change up when their cache expires.
+		log.Println("events:", err)
+	}
+}
+
+// evictRoutes removes the cached routes matching an event.
+func (h *Handler) evictRoutes(event RouteEvent) {
+	for _, key := range h.cache.Keys() {
+		// Route path: /route/{chain_id}/{project_id}
+		parts := strings.Split(key.(string), "/")
+		if len(parts) != 4 {
+			continue
+		}
+		if (event.Chain == "" || event.Chain == parts[2]) && (event.Project == "" || event.Project == parts[3]) {
+			h.cache.Remove(key)
+		}
+	}
+}
+
+// Events streams route events to gateways as server-sent events. Gateways
+// resume from the Last-Event-ID header after reconnecting; new subscribers
+// only get the events published from then on.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, last := h.events.subscribe()
+	defer h.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Replay what the gateway missed, then stream from the poller. Recent
+	// events are replayed too, as they may have been committed after higher
+	// ids; evicting twice is harmless.
+	if since, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		missed := []RouteEvent{}
+		err := h.db.Select(&missed, `SELECT * FROM route_events
+			WHERE (id > $1 OR create_time > now() - $3 * interval '1 second') AND id <= $2 ORDER BY id`,
+			since, last, eventsOverlap.Seconds())
+		if err != nil {
+			log.Println("events:", err)
+			return
+		}
+		for _, event := range missed {
+			writeEvent(w, event)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event RouteEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data)
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -21,6 +25,21 @@ type Chain struct {
 	REST    string `json:"rest" db:"rest" validate:"omitempty,url"`
 	ETH_RPC string `json:"eth_rpc" db:"eth_rpc" validate:"omitempty,url"`
 	ETH_WS  string `json:"eth_ws" db:"eth_ws" validate:"omitempty,url"`
+
+	Balancer  string     `json:"balancer" db:"balancer" validate:"omitempty,oneof=round_robin least_request weighted"`
+	Upstreams []Upstream `json:"upstreams,omitempty" db:"-" validate:"dive"`
+	RateLimit float64    `json:"rate_limit" db:"rate_limit" validate:"gte=0"`
+	RateBurst int        `json:"rate_burst" db:"rate_burst" validate:"gte=0"`
+
+	// Methods defaults to denying unsafe methods when not given.
+	Methods MethodPolicies `json:"methods,omitempty" db:"methods" validate:"dive,keys,oneof=rpc eth,endkeys"`
+}
+
+type Upstream struct {
+	Chain    string `json:"-" db:"chain"`
+	Protocol string `json:"protocol" db:"protocol" validate:"oneof=rpc ws grpc rest eth_rpc eth_ws"`
+	URL      string `json:"url" db:"url" validate:"required"`
+	Weight   int    `json:"weight" db:"weight" validate:"gte=0"`
 }
 
 type Project struct {
@@ -30,6 +49,18 @@ type Project struct {
 	Status     string    `json:"status" db:"status"`
 	Secret     string    `json:"secret" db:"secret"`
 	CreateTime time.Time `json:"-" db:"create_time"`
+	RateLimit  float64   `json:"rate_limit" db:"rate_limit" validate:"gte=0"`
+	RateBurst  int       `json:"rate_burst" db:"rate_burst" validate:"gte=0"`
+
+	DailyQuotaSoft   int64 `json:"daily_quota_soft" db:"daily_quota_soft" validate:"gte=0"`
+	DailyQuotaHard   int64 `json:"daily_quota_hard" db:"daily_quota_hard" validate:"gte=0"`
+	MonthlyQuotaSoft int64 `json:"monthly_quota_soft" db:"monthly_quota_soft" validate:"gte=0"`
+	MonthlyQuotaHard int64 `json:"monthly_quota_hard" db:"monthly_quota_hard" validate:"gte=0"`
+
+	RequireSecret bool    `json:"require_secret" db:"require_secret"`
+	Origins       Origins `json:"origins" db:"origins" validate:"dive,required,max=253"`
+	IPs           IPs     `json:"ips" db:"ips"`
+	CORS          CORS    `json:"cors" db:"cors"`
 }
 
 type Route struct {
@@ -42,6 +73,35 @@ type Route struct {
 		ETH_RPC string `json:"eth_rpc" default:""`
 		ETH_WS  string `json:"eth_ws" default:""`
 	} `json:"target"`
+	Balancer  string                     `json:"balancer"`
+	Upstreams map[string][]RouteUpstream `json:"upstreams"`
+	Limits    struct {
+		Project RouteLimit `json:"project"`
+		Chain   RouteLimit `json:"chain"`
+	} `json:"limits"`
+	Quota struct {
+		Daily   Quota `json:"daily"`
+		Monthly Quota `json:"monthly"`
+	} `json:"quota"`
+	Methods MethodPolicies `json:"methods"`
+	Auth    struct {
+		RequireSecret bool       `json:"require_secret"`
+		SecretHash    string     `json:"secret_hash"`
+		Keys          []RouteKey `json:"keys"`
+	} `json:"auth"`
+	Origins Origins `json:"origins"`
+	IPs     IPs     `json:"ips"`
+	CORS    CORS    `json:"cors"`
+}
+
+type RouteLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type RouteUpstream struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
 }
 
 type Response struct {
@@ -64,24 +124,41 @@ type Handler struct {
 	db       *sqlx.DB
 	validate *validator.Validate
 	cache    *lru.Cache
+	events   *Events
 }
 
-func NewHandler(db *sqlx.DB) *Handler {
+func NewHandler(db *sqlx.DB, events *Events) *Handler {
 	cache, _ := lru.New(128)
-	return &Handler{
+	h := &Handler{
 		db:       db,
 		validate: validator.New(),
 		cache:    cache,
+		events:   events,
 	}
+	events.evict = h.evictRoutes
+	return h
 }
 
 func (h *Handler) ListChains(w http.ResponseWriter, r *http.Request) {
 	chains := []Chain{}
 	if err := h.db.Select(&chains, "SELECT * FROM chains"); err != nil {
 		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
-	} else {
-		render.Respond(w, r, NewResponse(http.StatusOK, chains, nil))
+		return
+	}
+
+	upstreams := []Upstream{}
+	if err := h.db.Select(&upstreams, "SELECT * FROM upstreams ORDER BY chain, protocol, url"); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	for i := range chains {
+		for _, upstream := range upstreams {
+			if upstream.Chain == chains[i].ID {
+				chains[i].Upstreams = append(chains[i].Upstreams, upstream)
+			}
+		}
 	}
+	render.Respond(w, r, NewResponse(http.StatusOK, chains, nil))
 }
 
 func (h *Handler) GetChain(w http.ResponseWriter, r *http.Request) {
@@ -89,9 +166,13 @@ func (h *Handler) GetChain(w http.ResponseWriter, r *http.Request) {
 	chain := Chain{}
 	if err := h.db.Get(&chain, "SELECT * FROM chains WHERE id=$1", chainID); err != nil {
 		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, err))
-	} else {
-		render.Respond(w, r, NewResponse(http.StatusOK, chain, nil))
+		return
 	}
+	if err := h.db.Select(&chain.Upstreams, "SELECT * FROM upstreams WHERE chain=$1 ORDER BY protocol, url", chainID); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	render.Respond(w, r, NewResponse(http.StatusOK, chain, nil))
 }
 
 func (h *Handler) CreateChain(w http.ResponseWriter, r *http.Request) {
@@ -104,19 +185,150 @@ func (h *Handler) CreateChain(w http.ResponseWriter, r *http.Request) {
 		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
 		return
 	}
+	if chain.Balancer == "" {
+		chain.Balancer = "round_robin"
+	}
 
-	if _, err := h.db.NamedExec(`INSERT INTO chains VALUES (:id,:rpc,:ws,:grpc,:rest,:eth_rpc,:eth_ws)`, chain); err != nil {
+	// The single targets are also the first upstream of their protocol.
+	upstreams := []Upstream{}
+	for protocol, url := range map[string]string{
+		"rpc": chain.RPC, "ws": chain.WS, "grpc": chain.GRPC,
+		"rest": chain.REST, "eth_rpc": chain.ETH_RPC, "eth_ws": chain.ETH_WS,
+	} {
+		if url != "" {
+			upstreams = append(upstreams, Upstream{Protocol: protocol, URL: url, Weight: 1})
+		}
+	}
+	for _, upstream := range chain.Upstreams {
+		if !containsUpstream(upstreams, upstream) {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	for i := range upstreams {
+		upstreams[i].Chain = chain.ID
+		if err := h.validateUpstream(&upstreams[i]); err != nil {
+			render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+			return
+		}
+	}
+	chain.Upstreams = upstreams
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.NamedExec(`INSERT INTO chains (id,rpc,ws,grpc,rest,eth_rpc,eth_ws,balancer,rate_limit,rate_burst)
+		VALUES (:id,:rpc,:ws,:grpc,:rest,:eth_rpc,:eth_ws,:balancer,:rate_limit,:rate_burst)`, chain); err != nil {
 		// UniqueViolation 23505
 		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
 			render.Respond(w, r, NewResponse(http.StatusConflict, nil, err))
 		} else {
 			render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
 		}
+		return
+	}
+	if chain.Methods != nil {
+		_, err = tx.Exec("UPDATE chains SET methods=$1 WHERE id=$2", chain.Methods, chain.ID)
+	} else {
+		err = tx.Get(&chain.Methods, "SELECT methods FROM chains WHERE id=$1", chain.ID)
+	}
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	for _, upstream := range chain.Upstreams {
+		if _, err := tx.NamedExec(`INSERT INTO upstreams VALUES (:chain,:protocol,:url,:weight)`, upstream); err != nil {
+			render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
 	} else {
 		render.Respond(w, r, NewResponse(http.StatusOK, chain, nil))
 	}
 }
 
+func (h *Handler) ListUpstreams(w http.ResponseWriter, r *http.Request) {
+	chainID := chi.URLParam(r, "chainID")
+	upstreams := []Upstream{}
+	if err := h.db.Select(&upstreams, "SELECT * FROM upstreams WHERE chain=$1 ORDER BY protocol, url", chainID); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+	} else {
+		render.Respond(w, r, NewResponse(http.StatusOK, upstreams, nil))
+	}
+}
+
+func (h *Handler) CreateUpstream(w http.ResponseWriter, r *http.Request) {
+	upstream := Upstream{}
+	if err := render.Decode(r, &upstream); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	upstream.Chain = chi.URLParam(r, "chainID")
+	if err := h.validateUpstream(&upstream); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	chain := Chain{}
+	if err := h.db.Get(&chain, "SELECT * FROM chains WHERE id=$1", upstream.Chain); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, err))
+		return
+	}
+
+	if _, err := h.db.NamedExec(`INSERT INTO upstreams VALUES (:chain,:protocol,:url,:weight)
+		ON CONFLICT (chain, protocol, url) DO UPDATE SET weight=EXCLUDED.weight`, upstream); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+	} else {
+		h.publish(upstream.Chain, "")
+		render.Respond(w, r, NewResponse(http.StatusOK, upstream, nil))
+	}
+}
+
+// DeleteUpstream removes the upstream given by the protocol and url query
+// parameters.
+func (h *Handler) DeleteUpstream(w http.ResponseWriter, r *http.Request) {
+	chainID := chi.URLParam(r, "chainID")
+	protocol, url := r.URL.Query().Get("protocol"), r.URL.Query().Get("url")
+	result, err := h.db.Exec("DELETE FROM upstreams WHERE chain=$1 AND protocol=$2 AND url=$3", chainID, protocol, url)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish(chainID, "")
+	render.Respond(w, r, NewResponse(http.StatusOK, nil, nil))
+}
+
+func (h *Handler) validateUpstream(upstream *Upstream) error {
+	if upstream.Weight == 0 {
+		upstream.Weight = 1
+	}
+	if err := h.validate.Struct(upstream); err != nil {
+		return err
+	}
+	if upstream.Protocol == "grpc" {
+		return h.validate.Var(upstream.URL, "hostname_port")
+	}
+	return h.validate.Var(upstream.URL, "url")
+}
+
+func containsUpstream(upstreams []Upstream, upstream Upstream) bool {
+	for _, u := range upstreams {
+		if u.Protocol == upstream.Protocol && u.URL == upstream.URL {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) ListProjects(w http.ResponseWriter, r *http.Request) {
 	projects := []Project{}
 	if err := h.db.Select(&projects, "SELECT * FROM projects"); err != nil {
@@ -157,13 +369,69 @@ func (h *Handler) CreateProject(w http.ResponseWriter, r *http.Request) {
 	project.Secret = RandStringBytesRemainder(32)
 	project.Status = "Active"
 	// project.CreateTime = time.Now()
-	if _, err := h.db.NamedExec(`INSERT INTO projects VALUES (:id,:name,:chain,:status,:secret)`, project); err != nil {
+	if _, err := h.db.NamedExec(`INSERT INTO projects (id,name,chain,status,secret,rate_limit,rate_burst,
+		daily_quota_soft,daily_quota_hard,monthly_quota_soft,monthly_quota_hard,require_secret,origins,ips,cors)
+		VALUES (:id,:name,:chain,:status,:secret,:rate_limit,:rate_burst,
+		:daily_quota_soft,:daily_quota_hard,:monthly_quota_soft,:monthly_quota_hard,:require_secret,:origins,:ips,:cors)`, project); err != nil {
 		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
 	} else {
 		render.Respond(w, r, NewResponse(http.StatusOK, project, nil))
 	}
 }
 
+// UpdateProjectAuth turns requiring the project secret on or off.
+func (h *Handler) UpdateProjectAuth(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+	auth := struct {
+		RequireSecret bool `json:"require_secret"`
+	}{}
+	if err := render.Decode(r, &auth); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE projects SET require_secret=$1 WHERE id=$2", auth.RequireSecret, projectID)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish("", projectID)
+	render.Respond(w, r, NewResponse(http.StatusOK, auth, nil))
+}
+
+// UpdateProjectStatus activates or suspends a project, gateways stop routing
+// suspended projects.
+func (h *Handler) UpdateProjectStatus(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+	status := struct {
+		Status string `json:"status" validate:"oneof=Active Suspended"`
+	}{}
+	if err := render.Decode(r, &status); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	if err := h.validate.Struct(status); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE projects SET status=$1 WHERE id=$2", status.Status, projectID)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish("", projectID)
+	render.Respond(w, r, NewResponse(http.StatusOK, status, nil))
+}
+
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	if err := h.db.Ping(); err != nil {
 		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
@@ -172,6 +440,8 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Clear empties the route cache of this replica only, route events evict
+// the routes of gateways.
 func (h *Handler) Clear(w http.ResponseWriter, r *http.Request) {
 	h.cache.Purge()
 	render.Respond(w, r, NewResponse(http.StatusOK, nil, nil))
@@ -185,8 +455,10 @@ func (h *Handler) Route(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if val, ok := h.cache.Get(r.URL.Path); ok {
-		route := val.(*Route)
-		render.Respond(w, r, route)
+		// Usage changes all the time, only the quotas themselves are cached.
+		route := *val.(*Route)
+		h.fillUsage(&route, projectID)
+		render.Respond(w, r, &route)
 		return
 	}
 
@@ -196,6 +468,11 @@ func (h *Handler) Route(w http.ResponseWriter, r *http.Request) {
 		render.Respond(w, r, Route{})
 		return
 	}
+	project := Project{}
+	if err := h.db.Get(&project, "SELECT * FROM projects WHERE id=$1", projectID); err != nil || project.Status != "Active" {
+		render.Respond(w, r, Route{})
+		return
+	}
 
 	route := Route{
 		Route: true,
@@ -214,30 +491,106 @@ func (h *Handler) Route(w http.ResponseWriter, r *http.Request) {
 			ETH_RPC: chain.ETH_RPC,
 			ETH_WS:  chain.ETH_WS,
 		},
+		Balancer:  chain.Balancer,
+		Upstreams: map[string][]RouteUpstream{},
+		Methods:   chain.Methods,
+	}
+
+	upstreams := []Upstream{}
+	if err := h.db.Select(&upstreams, "SELECT * FROM upstreams WHERE chain=$1 ORDER BY protocol, url", chainID); err != nil {
+		render.Respond(w, r, Route{})
+		return
+	}
+	for _, upstream := range upstreams {
+		route.Upstreams[upstream.Protocol] = append(route.Upstreams[upstream.Protocol],
+			RouteUpstream{URL: upstream.URL, Weight: upstream.Weight})
+	}
+	route.Limits.Project = RouteLimit{Rate: project.RateLimit, Burst: project.RateBurst}
+	route.Limits.Chain = RouteLimit{Rate: chain.RateLimit, Burst: chain.RateBurst}
+	route.Quota.Daily = Quota{Soft: project.DailyQuotaSoft, Hard: project.DailyQuotaHard}
+	route.Quota.Monthly = Quota{Soft: project.MonthlyQuotaSoft, Hard: project.MonthlyQuotaHard}
+	route.Origins = project.Origins
+	route.IPs = project.IPs
+	route.CORS = project.CORS
+	// Gateways only get a digest of the secret to verify it.
+	route.Auth.RequireSecret = project.RequireSecret
+	if project.RequireSecret {
+		sum := sha256.Sum256([]byte(project.Secret))
+		route.Auth.SecretHash = hex.EncodeToString(sum[:])
+	}
+	keys := []ProjectKey{}
+	if err := h.db.Select(&keys, "SELECT * FROM project_keys WHERE project=$1 ORDER BY create_time", projectID); err != nil {
+		render.Respond(w, r, Route{})
+		return
+	}
+	route.Auth.Keys = []RouteKey{}
+	for _, key := range keys {
+		route.Auth.Keys = append(route.Auth.Keys, RouteKey{Kid: key.Kid, Alg: key.Alg, PublicKey: key.PublicKey})
 	}
 	h.cache.Add(r.URL.Path, &route)
-	render.Respond(w, r, route)
+
+	usage := route
+	h.fillUsage(&usage, projectID)
+	render.Respond(w, r, &usage)
 }
 
-func NewRouter(db *sqlx.DB) *chi.Mux {
+// requireToken only lets requests carrying token as a bearer token through,
+// none when token is empty.
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				render.Status(r, http.StatusUnauthorized)
+				render.Respond(w, r, NewResponse(http.StatusUnauthorized, nil, nil))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func NewRouter(db *sqlx.DB, events *Events, token string) *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	h := NewHandler(db)
+	h := NewHandler(db, events)
 	r.Get("/health", h.Health)
-	r.Get("/clear", h.Clear)
 	r.Get("/route/{chainID}/{projectID}", h.Route)
 	r.Route("/chains", func(r chi.Router) {
 		r.Get("/", h.ListChains)
 		r.Post("/", h.CreateChain)
 		r.Get("/{chainID}", h.GetChain)
+		r.Get("/{chainID}/upstreams", h.ListUpstreams)
+		r.Post("/{chainID}/upstreams", h.CreateUpstream)
+		r.Delete("/{chainID}/upstreams", h.DeleteUpstream)
+		r.Put("/{chainID}/methods", h.UpdateMethods)
 	})
 	r.Route("/projects", func(r chi.Router) {
 		r.Get("/", h.ListProjects)
 		r.Post("/", h.CreateProject)
 		r.Get("/{projectID}", h.GetProject)
+		r.Get("/{projectID}/usage", h.GetUsage)
+		r.Put("/{projectID}/auth", h.UpdateProjectAuth)
+		r.Put("/{projectID}/status", h.UpdateProjectStatus)
+		r.Put("/{projectID}/origins", h.UpdateOrigins)
+		r.Put("/{projectID}/ips", h.UpdateIPs)
+		r.Put("/{projectID}/cors", h.UpdateCORS)
+		r.Get("/{projectID}/keys", h.ListKeys)
+		r.Post("/{projectID}/keys", h.CreateKey)
+		r.Delete("/{projectID}/keys/{kid}", h.DeleteKey)
+	})
+	// Shared state of the gateways
+	r.Group(func(r chi.Router) {
+		r.Use(requireToken(token))
+		r.Get("/clear", h.Clear)
+		r.Get("/events", h.Events)
+		r.Post("/usage", h.AddUsage)
+		r.Get("/denylist", h.ListDenylist)
+		r.Post("/denylist", h.AddDenylist)
+		r.Delete("/denylist", h.DeleteDenylist)
 	})
 	return r
 }
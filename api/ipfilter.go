@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// IPs are the client IPs and CIDRs a project may be used from, stored as
+// jsonb. Deny always wins; when Allow isn't empty, clients must also match it.
+type IPs struct {
+	Allow []string `json:"allow" validate:"dive,cidr|ip"`
+	Deny  []string `json:"deny" validate:"dive,cidr|ip"`
+}
+
+func (i IPs) Value() (driver.Value, error) {
+	if i.Allow == nil {
+		i.Allow = []string{}
+	}
+	if i.Deny == nil {
+		i.Deny = []string{}
+	}
+	return json.Marshal(i)
+}
+
+func (i *IPs) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, i)
+	case string:
+		return json.Unmarshal([]byte(v), i)
+	}
+	return errors.New("ips: unsupported type")
+}
+
+// DenylistEntry blocks a client IP or CIDR for every project.
+type DenylistEntry struct {
+	CIDR       string    `json:"cidr" db:"cidr" validate:"cidr|ip"`
+	Reason     string    `json:"reason" db:"reason"`
+	CreateTime time.Time `json:"create_time" db:"create_time"`
+}
+
+// UpdateIPs replaces the client IPs a project may be used from.
+func (h *Handler) UpdateIPs(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+	ips := IPs{}
+	if err := render.Decode(r, &ips); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	if err := h.validate.Struct(ips); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE projects SET ips=$1 WHERE id=$2", ips, projectID)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish("", projectID)
+	render.Respond(w, r, NewResponse(http.StatusOK, ips, nil))
+}
+
+// ListDenylist is polled by the gateways.
+func (h *Handler) ListDenylist(w http.ResponseWriter, r *http.Request) {
+	entries := []DenylistEntry{}
+	if err := h.db.Select(&entries, "SELECT cidr::text AS cidr, reason, create_time FROM denylist ORDER BY cidr"); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+	} else {
+		render.Respond(w, r, NewResponse(http.StatusOK, entries, nil))
+	}
+}
+
+func (h *Handler) AddDenylist(w http.ResponseWriter, r *http.Request) {
+	entry := DenylistEntry{}
+	if err := render.Decode(r, &entry); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	if err := h.validate.Struct(entry); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	if err := h.db.Get(&entry.CreateTime, `INSERT INTO denylist (cidr,reason) VALUES ($1,$2)
+		ON CONFLICT (cidr) DO UPDATE SET reason=EXCLUDED.reason RETURNING create_time`, entry.CIDR, entry.Reason); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+	} else {
+		render.Respond(w, r, NewResponse(http.StatusOK, entry, nil))
+	}
+}
+
+// DeleteDenylist unblocks the CIDR given by the cidr query parameter.
+func (h *Handler) DeleteDenylist(w http.ResponseWriter, r *http.Request) {
+	cidr := r.URL.Query().Get("cidr")
+	if err := h.validate.Var(cidr, "cidr|ip"); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	result, err := h.db.Exec("DELETE FROM denylist WHERE cidr=$1::cidr", cidr)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	render.Respond(w, r, NewResponse(http.StatusOK, nil, nil))
+}
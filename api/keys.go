@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/jackc/pgconn"
+)
+
+// ProjectKey is a public key a project signs access tokens with. Keys are
+// rotated by adding the new key, moving the signer to its kid and deleting
+// the old key once its tokens have expired.
+type ProjectKey struct {
+	Project    string    `json:"-" db:"project"`
+	Kid        string    `json:"kid" db:"kid" validate:"required,max=64"`
+	Alg        string    `json:"alg" db:"alg" validate:"oneof=RS256 ES256 EdDSA"`
+	PublicKey  string    `json:"public_key" db:"public_key" validate:"required"`
+	CreateTime time.Time `json:"create_time" db:"create_time"`
+}
+
+type RouteKey struct {
+	Kid       string `json:"kid"`
+	Alg       string `json:"alg"`
+	PublicKey string `json:"public_key"`
+}
+
+func (h *Handler) ListKeys(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+	keys := []ProjectKey{}
+	if err := h.db.Select(&keys, "SELECT * FROM project_keys WHERE project=$1 ORDER BY create_time", projectID); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+	} else {
+		render.Respond(w, r, NewResponse(http.StatusOK, keys, nil))
+	}
+}
+
+func (h *Handler) CreateKey(w http.ResponseWriter, r *http.Request) {
+	key := ProjectKey{}
+	if err := render.Decode(r, &key); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	key.Project = chi.URLParam(r, "projectID")
+	if err := h.validate.Struct(key); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	if err := validatePublicKey(key.Alg, key.PublicKey); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	project := Project{}
+	if err := h.db.Get(&project, "SELECT * FROM projects WHERE id=$1", key.Project); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, err))
+		return
+	}
+
+	if err := h.db.Get(&key.CreateTime, `INSERT INTO project_keys (project,kid,alg,public_key)
+		VALUES ($1,$2,$3,$4) RETURNING create_time`, key.Project, key.Kid, key.Alg, key.PublicKey); err != nil {
+		// UniqueViolation 23505
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
+			render.Respond(w, r, NewResponse(http.StatusConflict, nil, err))
+		} else {
+			render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		}
+		return
+	}
+	h.publish("", key.Project)
+	render.Respond(w, r, NewResponse(http.StatusOK, key, nil))
+}
+
+// DeleteKey revokes a key, tokens signed with it are rejected from then on.
+func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
+	projectID, kid := chi.URLParam(r, "projectID"), chi.URLParam(r, "kid")
+	result, err := h.db.Exec("DELETE FROM project_keys WHERE project=$1 AND kid=$2", projectID, kid)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish("", projectID)
+	render.Respond(w, r, NewResponse(http.StatusOK, nil, nil))
+}
+
+// validatePublicKey checks that data is a PEM encoded public key for alg.
+func validatePublicKey(alg, data string) error {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return errors.New("public_key: invalid PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" && k.N.BitLen() >= 2048 {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && k.Curve == elliptic.P256() {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			return nil
+		}
+	}
+	return errors.New("public_key: doesn't match alg")
+}
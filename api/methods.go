@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// MethodPolicy restricts the JSON-RPC methods of a chain. A method matching
+// Deny is always rejected; when Allow isn't empty, a method must also match
+// it. Patterns may end with * to match any suffix.
+type MethodPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// MethodPolicies are the method policies of a chain by path prefix, rpc for
+// substrate and eth for evm methods. They are stored as jsonb.
+type MethodPolicies map[string]MethodPolicy
+
+func (m MethodPolicies) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+	return json.Marshal(m)
+}
+
+func (m *MethodPolicies) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, m)
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	}
+	return errors.New("methods: unsupported type")
+}
+
+// UpdateMethods replaces the method policies of a chain.
+func (h *Handler) UpdateMethods(w http.ResponseWriter, r *http.Request) {
+	chainID := chi.URLParam(r, "chainID")
+	methods := MethodPolicies{}
+	if err := render.Decode(r, &methods); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	if err := h.validate.Var(methods, "dive,keys,oneof=rpc eth,endkeys"); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE chains SET methods=$1 WHERE id=$2", methods, chainID)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish(chainID, "")
+	render.Respond(w, r, NewResponse(http.StatusOK, methods, nil))
+}
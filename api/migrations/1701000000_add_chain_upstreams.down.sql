@@ -0,0 +1,2 @@
+ALTER TABLE public.chains DROP COLUMN balancer;
+DROP TABLE public.upstreams;
\ No newline at end of file
@@ -0,0 +1,26 @@
+--
+-- TABLE: upstreams
+--
+CREATE TABLE public.upstreams (
+    chain text NOT NULL,
+    protocol text NOT NULL,
+    url text NOT NULL,
+    weight integer NOT NULL DEFAULT 1
+);
+
+ALTER TABLE ONLY public.upstreams
+    ADD CONSTRAINT upstreams_pkey PRIMARY KEY (chain, protocol, url);
+ALTER TABLE ONLY public.upstreams
+    ADD CONSTRAINT upstreams_chain_id_fk FOREIGN KEY (chain) REFERENCES public.chains(id) ON DELETE CASCADE;
+
+-- Existing single targets become the first upstream of each protocol
+INSERT INTO public.upstreams (chain, protocol, url)
+    SELECT id, 'rpc', rpc FROM public.chains WHERE rpc <> ''
+    UNION ALL SELECT id, 'ws', ws FROM public.chains WHERE ws <> ''
+    UNION ALL SELECT id, 'grpc', grpc FROM public.chains WHERE grpc <> ''
+    UNION ALL SELECT id, 'rest', rest FROM public.chains WHERE rest <> ''
+    UNION ALL SELECT id, 'eth_rpc', eth_rpc FROM public.chains WHERE eth_rpc <> ''
+    UNION ALL SELECT id, 'eth_ws', eth_ws FROM public.chains WHERE eth_ws <> '';
+
+-- Load balancing strategy: round_robin | least_request | weighted
+ALTER TABLE public.chains ADD COLUMN balancer text NOT NULL DEFAULT 'round_robin';
@@ -0,0 +1,4 @@
+ALTER TABLE public.chains DROP COLUMN rate_limit;
+ALTER TABLE public.chains DROP COLUMN rate_burst;
+ALTER TABLE public.projects DROP COLUMN rate_limit;
+ALTER TABLE public.projects DROP COLUMN rate_burst;
@@ -0,0 +1,5 @@
+-- Token bucket limits in requests per second, 0 means unlimited
+ALTER TABLE public.chains ADD COLUMN rate_limit double precision NOT NULL DEFAULT 0;
+ALTER TABLE public.chains ADD COLUMN rate_burst integer NOT NULL DEFAULT 0;
+ALTER TABLE public.projects ADD COLUMN rate_limit double precision NOT NULL DEFAULT 0;
+ALTER TABLE public.projects ADD COLUMN rate_burst integer NOT NULL DEFAULT 0;
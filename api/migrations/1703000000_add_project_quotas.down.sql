@@ -0,0 +1,5 @@
+DROP TABLE public.project_usage;
+ALTER TABLE public.projects DROP COLUMN daily_quota_soft;
+ALTER TABLE public.projects DROP COLUMN daily_quota_hard;
+ALTER TABLE public.projects DROP COLUMN monthly_quota_soft;
+ALTER TABLE public.projects DROP COLUMN monthly_quota_hard;
@@ -0,0 +1,20 @@
+-- Request quotas, 0 means unlimited
+ALTER TABLE public.projects ADD COLUMN daily_quota_soft bigint NOT NULL DEFAULT 0;
+ALTER TABLE public.projects ADD COLUMN daily_quota_hard bigint NOT NULL DEFAULT 0;
+ALTER TABLE public.projects ADD COLUMN monthly_quota_soft bigint NOT NULL DEFAULT 0;
+ALTER TABLE public.projects ADD COLUMN monthly_quota_hard bigint NOT NULL DEFAULT 0;
+
+--
+-- TABLE: project_usage
+--
+CREATE TABLE public.project_usage (
+    project text NOT NULL,
+    period text NOT NULL,
+    start date NOT NULL,
+    count bigint NOT NULL DEFAULT 0
+);
+
+ALTER TABLE ONLY public.project_usage
+    ADD CONSTRAINT project_usage_pkey PRIMARY KEY (project, period, start);
+ALTER TABLE ONLY public.project_usage
+    ADD CONSTRAINT project_usage_project_id_fk FOREIGN KEY (project) REFERENCES public.projects(id) ON DELETE CASCADE;
@@ -0,0 +1 @@
+ALTER TABLE public.chains DROP COLUMN methods;
@@ -0,0 +1,6 @@
+-- JSON-RPC method policies by path prefix, {"rpc": {"allow": [], "deny": []}, "eth": {...}}.
+-- Patterns may end with * to match any suffix. Unsafe methods are denied by default.
+ALTER TABLE public.chains ADD COLUMN methods jsonb NOT NULL DEFAULT '{
+  "rpc": {"allow": [], "deny": ["author_rotateKeys", "author_insertKey", "author_hasKey", "author_hasSessionKeys", "author_removeExtrinsic", "system_addReservedPeer", "system_removeReservedPeer", "system_addLogFilter", "system_resetLogFilter", "offchain_*"]},
+  "eth": {"allow": [], "deny": ["admin_*", "debug_*", "personal_*", "miner_*"]}
+}';
@@ -0,0 +1,2 @@
+-- Projects requiring their secret can't be used with the project ID alone
+ALTER TABLE public.projects ADD COLUMN require_secret boolean NOT NULL DEFAULT false;
@@ -0,0 +1,17 @@
+--
+-- TABLE: project_keys
+--
+-- Public keys (PEM) projects sign access tokens with, selected by kid.
+-- alg: RS256 | ES256 | EdDSA
+CREATE TABLE public.project_keys (
+    project text NOT NULL,
+    kid text NOT NULL,
+    alg text NOT NULL,
+    public_key text NOT NULL,
+    create_time timestamp WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE ONLY public.project_keys
+    ADD CONSTRAINT project_keys_pkey PRIMARY KEY (project, kid);
+ALTER TABLE ONLY public.project_keys
+    ADD CONSTRAINT project_keys_project_id_fk FOREIGN KEY (project) REFERENCES public.projects(id) ON DELETE CASCADE;
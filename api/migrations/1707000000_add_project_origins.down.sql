@@ -0,0 +1 @@
+ALTER TABLE public.projects DROP COLUMN origins;
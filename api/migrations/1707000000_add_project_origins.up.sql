@@ -0,0 +1,3 @@
+-- Origins browsers may use the project from, empty for any:
+-- ["https://app.example.com", "*.example.com"]
+ALTER TABLE public.projects ADD COLUMN origins jsonb NOT NULL DEFAULT '[]';
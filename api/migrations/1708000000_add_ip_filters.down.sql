@@ -0,0 +1,2 @@
+DROP TABLE public.denylist;
+ALTER TABLE public.projects DROP COLUMN ips;
@@ -0,0 +1,15 @@
+-- Client IPs and CIDRs a project may be used from: {"allow": [], "deny": []}
+ALTER TABLE public.projects ADD COLUMN ips jsonb NOT NULL DEFAULT '{"allow": [], "deny": []}';
+
+--
+-- TABLE: denylist
+--
+-- Client IPs and CIDRs blocked for every project
+CREATE TABLE public.denylist (
+    cidr cidr NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    create_time timestamp WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE ONLY public.denylist
+    ADD CONSTRAINT denylist_pkey PRIMARY KEY (cidr);
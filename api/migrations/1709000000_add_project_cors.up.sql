@@ -0,0 +1,3 @@
+-- CORS policy on top of the headers the gateway needs:
+-- {"allow_headers": [], "expose_headers": [], "max_age": 600, "allow_credentials": false}
+ALTER TABLE public.projects ADD COLUMN cors jsonb NOT NULL DEFAULT '{}';
@@ -0,0 +1,14 @@
+--
+-- TABLE: route_events
+--
+-- Changes to routes, published to gateways. An empty chain or project
+-- matches any.
+CREATE TABLE public.route_events (
+    id bigserial NOT NULL,
+    chain text NOT NULL DEFAULT '',
+    project text NOT NULL DEFAULT '',
+    create_time timestamp WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE ONLY public.route_events
+    ADD CONSTRAINT route_events_pkey PRIMARY KEY (id);
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// Origins are the origins a project may be used from, stored as jsonb. An
+// origin is https://app.example.com, app.example.com for any scheme or
+// *.example.com for any subdomain.
+type Origins []string
+
+func (o Origins) Value() (driver.Value, error) {
+	if o == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(o)
+}
+
+func (o *Origins) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*o = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, o)
+	case string:
+		return json.Unmarshal([]byte(v), o)
+	}
+	return errors.New("origins: unsupported type")
+}
+
+// UpdateOrigins replaces the origins a project may be used from.
+func (h *Handler) UpdateOrigins(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+	origins := Origins{}
+	if err := render.Decode(r, &origins); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	if err := h.validate.Var(origins, "dive,required,max=253"); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE projects SET origins=$1 WHERE id=$2", origins, projectID)
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, nil))
+		return
+	}
+	h.publish("", projectID)
+	render.Respond(w, r, NewResponse(http.StatusOK, origins, nil))
+}
@@ -12,8 +12,15 @@ import (
 func main() {
 	cfg := NewConfig()
 	db := NewSqlx(cfg)
-	router := NewRouter(db)
+	events := NewEvents(db)
+	if cfg.Api.Token == "" {
+		log.Println("Api.Token is not set, /events, /usage, /denylist and /clear are disabled")
+	}
+	router := NewRouter(db, events, cfg.Api.Token)
 	server := &http.Server{Addr: cfg.Api.Host + ":" + cfg.Api.Port, Handler: router}
+	// Event streams only end when the events are closed.
+	server.RegisterOnShutdown(events.Close)
+	go events.Run()
 
 	// Run the server & Graceful shutdown
 	serverCtx, serverStopCtx := context.WithCancel(context.Background())
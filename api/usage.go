@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// Quota of a project over one period. Used is the number of requests counted
+// so far in the current period; Start is the first day of that period.
+type Quota struct {
+	Soft  int64  `json:"soft"`
+	Hard  int64  `json:"hard"`
+	Used  int64  `json:"used"`
+	Start string `json:"start"`
+}
+
+// Usage is a number of requests the gateway served for a project on a day.
+type Usage struct {
+	Project string `json:"project" validate:"required"`
+	Day     string `json:"day" validate:"required,datetime=2006-01-02"`
+	Count   int64  `json:"count" validate:"gte=0"`
+}
+
+type usageRow struct {
+	Period string `db:"period"`
+	Count  int64  `db:"count"`
+}
+
+// usagePeriods returns the first day of the current day and month in UTC.
+func usagePeriods(now time.Time) (string, string) {
+	now = now.UTC()
+	return now.Format("2006-01-02"), now.Format("2006-01") + "-01"
+}
+
+// fillUsage sets the current usage of the route's quotas.
+func (h *Handler) fillUsage(route *Route, projectID string) {
+	day, month := usagePeriods(time.Now())
+	route.Quota.Daily.Start, route.Quota.Monthly.Start = day, month
+	route.Quota.Daily.Used, route.Quota.Monthly.Used = 0, 0
+
+	rows := []usageRow{}
+	stmt := `SELECT period, count FROM project_usage
+		WHERE project=$1 AND ((period='day' AND start=$2) OR (period='month' AND start=$3))`
+	if err := h.db.Select(&rows, stmt, projectID, day, month); err != nil {
+		return
+	}
+	for _, row := range rows {
+		switch row.Period {
+		case "day":
+			route.Quota.Daily.Used = row.Count
+		case "month":
+			route.Quota.Monthly.Used = row.Count
+		}
+	}
+}
+
+func (h *Handler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+	project := Project{}
+	if err := h.db.Get(&project, "SELECT * FROM projects WHERE id=$1", projectID); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusNotFound, nil, err))
+		return
+	}
+
+	route := Route{}
+	route.Quota.Daily = Quota{Soft: project.DailyQuotaSoft, Hard: project.DailyQuotaHard}
+	route.Quota.Monthly = Quota{Soft: project.MonthlyQuotaSoft, Hard: project.MonthlyQuotaHard}
+	h.fillUsage(&route, projectID)
+	render.Respond(w, r, NewResponse(http.StatusOK, route.Quota, nil))
+}
+
+// AddUsage adds the request counts reported by a gateway to the daily and
+// monthly usage of projects.
+func (h *Handler) AddUsage(w http.ResponseWriter, r *http.Request) {
+	usage := []Usage{}
+	if err := render.DecodeJSON(r.Body, &usage); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+		return
+	}
+	for _, u := range usage {
+		if err := h.validate.Struct(u); err != nil {
+			render.Respond(w, r, NewResponse(http.StatusBadRequest, nil, err))
+			return
+		}
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+		return
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO project_usage (project, period, start, count)
+		VALUES ($1, 'day', $2::date, $3), ($1, 'month', date_trunc('month', $2::date)::date, $3)
+		ON CONFLICT (project, period, start) DO UPDATE SET count = project_usage.count + EXCLUDED.count`
+	for _, u := range usage {
+		// Counts of deleted projects are dropped.
+		var exists bool
+		if err := tx.Get(&exists, "SELECT EXISTS (SELECT 1 FROM projects WHERE id=$1)", u.Project); err != nil {
+			render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+			return
+		}
+		if !exists {
+			continue
+		}
+		if _, err := tx.Exec(stmt, u.Project, u.Day, u.Count); err != nil {
+			render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		render.Respond(w, r, NewResponse(http.StatusInternalServerError, nil, err))
+	} else {
+		render.Respond(w, r, NewResponse(http.StatusOK, nil, nil))
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const defaultAdminAddr = ":8080"
+
+// AdminRoute is a route decision cached by the gateway.
+type AdminRoute struct {
+	Chain   string    `json:"chain"`
+	Project string    `json:"project"`
+	Route   bool      `json:"route"`
+	Expires time.Time `json:"expires"`
+	// Targets are the upstreams of the route by target (rpc, ws, grpc, ...).
+	Targets map[string][]UpstreamTarget `json:"targets,omitempty"`
+}
+
+// AdminUpstream is the state of an upstream of a loaded proxy.
+type AdminUpstream struct {
+	Chain    string `json:"chain"`
+	Protocol string `json:"protocol"`
+	Target   string `json:"target"`
+	// Index is the position of the upstream in the pool of its chain and
+	// protocol.
+	Index       int    `json:"index"`
+	Weight      int    `json:"weight"`
+	Healthy     bool   `json:"healthy"`
+	Breaker     string `json:"breaker"`
+	Outstanding int64  `json:"outstanding"`
+}
+
+// Admin serves the operator endpoints of the gateway. It must only be
+// exposed on a private listener, every request but the metrics scrapes
+// needs the admin token.
+type Admin struct {
+	token     atomic.Value // string
+	checker   *RouteChecker
+	evict     func(chain, project string)
+	upstreams func() []AdminUpstream
+	registry  *prometheus.Registry
+	metrics   http.Handler
+	mux       *http.ServeMux
+}
+
+func NewAdmin(token string, checker *RouteChecker, evict func(chain, project string), upstreams func() []AdminUpstream) *Admin {
+	a := &Admin{
+		checker:   checker,
+		evict:     evict,
+		upstreams: upstreams,
+		registry:  prometheus.NewRegistry(),
+		mux:       http.NewServeMux(),
+	}
+	a.SetToken(token)
+	a.registry.MustRegister(upstreamCollector{upstreams})
+	a.metrics = promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, a.registry}, promhttp.HandlerOpts{})
+	a.mux.HandleFunc("/health", a.health)
+	a.mux.HandleFunc("/routes", a.routes)
+	a.mux.HandleFunc("/upstreams", a.listUpstreams)
+	a.mux.Handle("/log/level", logLevel)
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return a
+}
+
+// Register adds collectors to the metrics of the gateway instance.
+func (a *Admin) Register(collectors ...prometheus.Collector) {
+	a.registry.MustRegister(collectors...)
+}
+
+// SetToken replaces the token admin requests must carry.
+func (a *Admin) SetToken(token string) {
+	a.token.Store(token)
+}
+
+func (a *Admin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Metrics carry no secrets, so they are scraped even without a token.
+	if req.URL.Path == "/metrics" {
+		a.metrics.ServeHTTP(rw, req)
+		return
+	}
+	token, expected := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), a.token.Load().(string)
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		zap.S().Errorw("admin", "path", req.URL.Path, "statue", http.StatusUnauthorized)
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	zap.S().Infow("admin", "method", req.Method, "path", req.URL.Path)
+	a.mux.ServeHTTP(rw, req)
+}
+
+func (a *Admin) health(rw http.ResponseWriter, req *http.Request) {
+	http.Error(rw, http.StatusText(http.StatusOK), http.StatusOK)
+}
+
+// routes lists the cached routes on GET and evicts those of the chain and/or
+// project query parameters on DELETE, every route without parameters.
+func (a *Admin) routes(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, a.checker.Routes())
+	case http.MethodDelete:
+		chain, project := req.URL.Query().Get("chain"), req.URL.Query().Get("project")
+		a.evict(chain, project)
+		writeJSON(rw, map[string]string{"chain": chain, "project": project})
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// listUpstreams dumps the health and circuit breaker state of the upstreams
+// of loaded proxies.
+func (a *Admin) listUpstreams(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, a.upstreams())
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
+// adminUpstreams describes the upstreams of a pool.
+func adminUpstreams(chain, protocol string, pool *UpstreamPool) []AdminUpstream {
+	upstreams := make([]AdminUpstream, 0, len(pool.Upstreams))
+	for i, u := range pool.Upstreams {
+		upstreams = append(upstreams, AdminUpstream{
+			Chain:       chain,
+			Protocol:    protocol,
+			Target:      u.Target,
+			Index:       i,
+			Weight:      u.Weight,
+			Healthy:     u.Healthy(),
+			Breaker:     u.breaker.State(),
+			Outstanding: u.Outstanding(),
+		})
+	}
+	return upstreams
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Header and gRPC metadata key carrying the project secret.
+const (
+	projectSecretHeader = "X-Project-Secret"
+	projectSecretKey    = "x-project-secret"
+)
+
+// RouteAuth tells how a project authenticates. SecretHash is the hex encoded
+// SHA-256 of the project secret, the secret itself never leaves the API. Keys
+// verify the project's access tokens, which may be used instead of the
+// secret; projects with keys always require one or the other.
+type RouteAuth struct {
+	RequireSecret bool       `json:"require_secret"`
+	SecretHash    string     `json:"secret_hash"`
+	Keys          []RouteKey `json:"keys"`
+
+	publicKeys map[string]projectKey
+}
+
+var errUnauthorized = errors.New("project secret or access token required")
+
+// authenticate checks the credentials sent with a request. An access token
+// that doesn't verify is rejected even when the project requires none.
+func (a RouteAuth) authenticate(secret, token, chain, project string) (*TokenClaims, error) {
+	if token != "" {
+		return a.VerifyToken(token, chain, project)
+	}
+	if !a.Verify(secret) {
+		return nil, errUnauthorized
+	}
+	return nil, nil
+}
+
+// Verify reports whether secret may use the project.
+func (a RouteAuth) Verify(secret string) bool {
+	if !a.Required() {
+		return true
+	}
+	if secret == "" || a.SecretHash == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(a.SecretHash)
+	if err != nil {
+		return false
+	}
+	// Comparing the digests keeps the time independent of the secret length.
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(sum[:], expected) == 1
+}
+
+// Required reports whether requests need credentials. Registering keys
+// requires them, or the project id alone would still be enough.
+func (a RouteAuth) Required() bool {
+	return a.RequireSecret || len(a.Keys) > 0
+}
+
+// projectSecret returns the secret sent in the X-Project-Secret header or as
+// the Basic auth password.
+func projectSecret(req *http.Request) string {
+	if secret := req.Header.Get(projectSecretHeader); secret != "" {
+		return secret
+	}
+	if _, password, ok := req.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// stripProjectSecret keeps the secret from being forwarded to upstreams.
+func stripProjectSecret(req *http.Request) {
+	req.Header.Del(projectSecretHeader)
+	if strings.HasPrefix(req.Header.Get("Authorization"), "Basic ") {
+		req.Header.Del("Authorization")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// CircuitBreakerConfig holds the thresholds of passive outlier detection.
+type CircuitBreakerConfig struct {
+	// Window is the number of most recent requests the error rate is
+	// computed over.
+	Window int
+	// MinRequests is the number of requests in the window before the error
+	// rate is taken into account.
+	MinRequests int
+	// FailureRatio trips the breaker once this share of the window failed.
+	FailureRatio float64
+	// ConsecutiveFailures trips the breaker regardless of the window.
+	ConsecutiveFailures int
+	// SlowCallDuration counts requests slower than this as failures.
+	SlowCallDuration time.Duration
+	// OpenDuration is how long a tripped upstream receives no traffic
+	// before trial requests are let through.
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of trial requests that must succeed to
+	// close the breaker again.
+	HalfOpenRequests int
+}
+
+// DefaultCircuitBreaker is used by every upstream.
+var DefaultCircuitBreaker = &CircuitBreakerConfig{
+	Window:              20,
+	MinRequests:         10,
+	FailureRatio:        0.5,
+	ConsecutiveFailures: 5,
+	SlowCallDuration:    10 * time.Second,
+	OpenDuration:        30 * time.Second,
+	HalfOpenRequests:    3,
+}
+
+// CircuitBreaker tracks the outcome of real requests to one upstream.
+type CircuitBreaker struct {
+	config *CircuitBreakerConfig
+	target string
+
+	mu          sync.Mutex
+	state       string
+	results     []bool // ring buffer of the latest outcomes, true on failure
+	next        int
+	count       int
+	failures    int
+	consecutive int
+	openedAt    time.Time
+	trials      int // trial requests in flight while half-open
+	successes   int // successful trial requests while half-open
+	// halfOpened counts the half-open periods, so that trials started in an
+	// earlier one aren't released from the current one.
+	halfOpened int
+}
+
+func NewCircuitBreaker(target string, config *CircuitBreakerConfig) *CircuitBreaker {
+	window := config.Window
+	if window <= 0 {
+		window = 1
+	}
+	return &CircuitBreaker{
+		config:  config,
+		target:  target,
+		state:   BreakerClosed,
+		results: make([]bool, window),
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Available reports whether the upstream may receive a request. An open
+// breaker turns half-open once OpenDuration has passed.
+func (b *CircuitBreaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenDuration {
+			return false
+		}
+		b.state, b.trials, b.successes = BreakerHalfOpen, 0, 0
+		b.halfOpened++
+		zap.S().Infow("breaker", "target", b.target, "state", b.state)
+		return true
+	case BreakerHalfOpen:
+		return b.trials < b.config.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// start is called when a request is sent to the upstream. The returned
+// function must be called once the request ends, whether or not its outcome
+// was recorded, so that trial requests don't hold the half-open breaker.
+func (b *CircuitBreaker) start() (done func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerHalfOpen {
+		return func() {}
+	}
+	b.trials++
+	period := b.halfOpened
+	return func() {
+		b.mu.Lock()
+		if b.state == BreakerHalfOpen && b.halfOpened == period && b.trials > 0 {
+			b.trials--
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Record reports the outcome of a request started with start.
+func (b *CircuitBreaker) Record(failed bool, latency time.Duration) {
+	if b.config.SlowCallDuration > 0 && latency > b.config.SlowCallDuration {
+		failed = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.trip()
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.reset()
+			zap.S().Infow("breaker", "target", b.target, "state", b.state)
+		}
+	case BreakerClosed:
+		if b.count == len(b.results) {
+			if b.results[b.next] {
+				b.failures--
+			}
+		} else {
+			b.count++
+		}
+		b.results[b.next] = failed
+		b.next = (b.next + 1) % len(b.results)
+		if failed {
+			b.failures++
+			b.consecutive++
+		} else {
+			b.consecutive = 0
+		}
+
+		if b.consecutive >= b.config.ConsecutiveFailures ||
+			(b.count >= b.config.MinRequests && float64(b.failures) >= b.config.FailureRatio*float64(b.count)) {
+			b.trip()
+		}
+	}
+}
+
+func (b *CircuitBreaker) trip() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	zap.S().Errorw("breaker", "target", b.target, "state", b.state,
+		"failures", b.failures, "requests", b.count, "consecutive", b.consecutive)
+}
+
+func (b *CircuitBreaker) reset() {
+	b.state = BreakerClosed
+	for i := range b.results {
+		b.results[i] = false
+	}
+	b.next, b.count, b.failures, b.consecutive = 0, 0, 0, 0
+}
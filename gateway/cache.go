@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRouteCacheTTL         = 30 * time.Second
+	defaultRouteCacheNegativeTTL = 5 * time.Second
+	routeCacheSweepInterval      = time.Minute
+)
+
+var errRouteLookup = errors.New("route lookup failed")
+
+// RouteChecker asks the gateway-api whether a project may use a chain and
+// caches the decision in-process. Allowed routes are kept for ttl, denied
+// ones for negativeTTL, and concurrent lookups for the same chain/project
+// share a single request to the API.
+type RouteChecker struct {
+	url         string
+	client      *http.Client
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*routeEntry
+	calls   map[string]*routeCall
+	// generation changes on every eviction so that lookups started before
+	// it don't cache what may be stale.
+	generation uint64
+}
+
+type routeEntry struct {
+	resp    *RouteResponse
+	expires time.Time
+}
+
+// routeCall is an in-flight lookup that later callers wait on.
+type routeCall struct {
+	wg   sync.WaitGroup
+	resp *RouteResponse
+	err  error
+}
+
+// apiTransport authenticates the requests to the gateway-api that change or
+// stream shared state.
+type apiTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func NewRouteChecker(url string, timeout, ttl, negativeTTL time.Duration) *RouteChecker {
+	c := &RouteChecker{
+		url:         url,
+		client:      &http.Client{Timeout: timeout},
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*routeEntry),
+		calls:       make(map[string]*routeCall),
+	}
+	go c.sweep()
+	return c
+}
+
+// Check returns the route decision for chain/project. The returned response
+// is shared between callers and must not be modified.
+func (c *RouteChecker) Check(chain, project string) (*RouteResponse, error) {
+	key := chain + "/" + project
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		routeCacheTotal.WithLabelValues("hit").Inc()
+		return entry.resp, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		routeCacheTotal.WithLabelValues("shared").Inc()
+		call.wg.Wait()
+		return call.resp, call.err
+	}
+	call := &routeCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+	routeCacheTotal.WithLabelValues("miss").Inc()
+
+	// Release the waiters even if the lookup panics, or they and every later
+	// lookup of the route would block forever.
+	defer func() {
+		if call.resp == nil && call.err == nil {
+			call.err = errRouteLookup
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	ts := time.Now()
+	call.resp, call.err = c.fetch(chain, project)
+	result := "ok"
+	if call.err != nil {
+		result = "error"
+	}
+	routeLookupDuration.WithLabelValues(result).Observe(time.Since(ts).Seconds())
+
+	c.mu.Lock()
+	switch {
+	case generation != c.generation:
+		// Evicted while fetching, the next lookup fetches again.
+	case call.err == nil && call.resp.Route:
+		c.entries[key] = &routeEntry{resp: call.resp, expires: time.Now().Add(c.ttl)}
+	case call.err == nil:
+		c.entries[key] = &routeEntry{resp: call.resp, expires: time.Now().Add(c.negativeTTL)}
+	case entry != nil:
+		// The API is unavailable: keep serving the last known decision and
+		// try again once the negative TTL has passed.
+		entry.expires = time.Now().Add(c.negativeTTL)
+		call.resp, call.err = entry.resp, nil
+	}
+	c.mu.Unlock()
+
+	return call.resp, call.err
+}
+
+// SetTTL changes how long decisions fetched from now on are cached.
+func (c *RouteChecker) SetTTL(ttl, negativeTTL time.Duration) {
+	c.mu.Lock()
+	c.ttl, c.negativeTTL = ttl, negativeTTL
+	c.mu.Unlock()
+}
+
+// Purge drops every cached decision.
+func (c *RouteChecker) Purge() {
+	c.mu.Lock()
+	c.entries = make(map[string]*routeEntry)
+	c.generation++
+	c.mu.Unlock()
+}
+
+// Evict drops the cached decisions for a chain and/or a project; an empty
+// chain or project matches any.
+func (c *RouteChecker) Evict(chain, project string) {
+	c.mu.Lock()
+	for key := range c.entries {
+		keyChain, keyProject, _ := strings.Cut(key, "/")
+		if (chain == "" || chain == keyChain) && (project == "" || project == keyProject) {
+			delete(c.entries, key)
+		}
+	}
+	c.generation++
+	c.mu.Unlock()
+}
+
+// Routes lists the cached decisions, with the upstreams of allowed routes.
+func (c *RouteChecker) Routes() []AdminRoute {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	routes := make([]AdminRoute, 0, len(c.entries))
+	for key, entry := range c.entries {
+		chain, project, _ := strings.Cut(key, "/")
+		route := AdminRoute{Chain: chain, Project: project, Route: entry.resp.Route, Expires: entry.expires}
+		if entry.resp.Route {
+			route.Targets = make(map[string][]UpstreamTarget)
+			for _, target := range []string{"rpc", "ws", "grpc", "rest", "eth_rpc", "eth_ws"} {
+				if targets := entry.resp.Targets(target); len(targets) > 0 {
+					route.Targets[target] = targets
+				}
+			}
+		}
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Chain != routes[j].Chain {
+			return routes[i].Chain < routes[j].Chain
+		}
+		return routes[i].Project < routes[j].Project
+	})
+	return routes
+}
+
+func (c *RouteChecker) fetch(chain, project string) (*RouteResponse, error) {
+	// Route URL: http://gateway-api/route/{chain_id}/{project_id}
+	url := fmt.Sprintf("%s/%s/%s", c.url, chain, project)
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("route: unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	routeResp := &RouteResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(routeResp); err != nil {
+		return nil, err
+	}
+	routeResp.Auth.parseKeys()
+	routeResp.IPs.parse()
+	routeResp.fetched = time.Now()
+	return routeResp, nil
+}
+
+// sweep periodically removes expired entries so that lookups for unknown
+// chains or projects don't accumulate forever.
+func (c *RouteChecker) sweep() {
+	ticker := time.NewTicker(routeCacheSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		c.mu.Lock()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRouteAPI answers route lookups, once release is closed when it is set,
+// and counts them.
+type testRouteAPI struct {
+	*httptest.Server
+	lookups  atomic.Int32
+	failing  atomic.Bool
+	received chan struct{}
+	release  chan struct{}
+}
+
+func newTestRouteAPI(t *testing.T, blocking bool) *testRouteAPI {
+	api := &testRouteAPI{received: make(chan struct{}, 16)}
+	if blocking {
+		api.release = make(chan struct{})
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		api.lookups.Add(1)
+		api.received <- struct{}{}
+		if api.release != nil {
+			<-api.release
+		}
+		if api.failing.Load() {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(rw).Encode(&RouteResponse{Route: true})
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func TestRouteCheckerSharesLookups(t *testing.T) {
+	api := newTestRouteAPI(t, true)
+	c := NewRouteChecker(api.URL+"/route", time.Second, time.Minute, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := c.Check("c", "p"); err != nil || !resp.Route {
+				t.Errorf("got %+v, %v, want an allowed route", resp, err)
+			}
+		}()
+	}
+	<-api.received
+	// Give the other lookups time to wait on the one in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(api.release)
+	wg.Wait()
+
+	if n := api.lookups.Load(); n != 1 {
+		t.Fatalf("got %d lookups, want 1 shared by every caller", n)
+	}
+	c.Check("c", "p")
+	if n := api.lookups.Load(); n != 1 {
+		t.Fatalf("got %d lookups, want the cached route to be used", n)
+	}
+}
+
+func TestRouteCheckerDoesNotCacheEvictedLookups(t *testing.T) {
+	api := newTestRouteAPI(t, true)
+	c := NewRouteChecker(api.URL+"/route", time.Second, time.Minute, time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		c.Check("c", "p")
+		close(done)
+	}()
+	<-api.received
+	// The route changes while its lookup is in flight.
+	c.Evict("c", "")
+	close(api.release)
+	<-done
+
+	c.Check("c", "p")
+	if n := api.lookups.Load(); n != 2 {
+		t.Fatalf("got %d lookups, want the evicted lookup to be fetched again", n)
+	}
+}
+
+func TestRouteCheckerServesStaleRouteOnError(t *testing.T) {
+	api := newTestRouteAPI(t, false)
+	c := NewRouteChecker(api.URL+"/route", time.Second, 10*time.Millisecond, 200*time.Millisecond)
+
+	if resp, err := c.Check("c", "p"); err != nil || !resp.Route {
+		t.Fatalf("got %+v, %v, want an allowed route", resp, err)
+	}
+	api.failing.Store(true)
+	time.Sleep(20 * time.Millisecond)
+	if resp, err := c.Check("c", "p"); err != nil || !resp.Route {
+		t.Fatalf("API unavailable: got %+v, %v, want the last known route", resp, err)
+	}
+	// The stale route is served for the negative TTL before trying again.
+	c.Check("c", "p")
+	if n := api.lookups.Load(); n != 2 {
+		t.Fatalf("got %d lookups, want 2", n)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if resp, err := c.Check("c", "p"); err != nil || !resp.Route {
+		t.Fatalf("API still unavailable: got %+v, %v, want the last known route", resp, err)
+	}
+	if n := api.lookups.Load(); n != 3 {
+		t.Fatalf("got %d lookups, want 3", n)
+	}
+
+	// Without a known route, errors are returned.
+	if _, err := c.Check("c", "q"); err == nil {
+		t.Fatalf("unknown route: got no error")
+	}
+}
+
+// panickingTransport panics once release is closed.
+type panickingTransport struct {
+	received chan struct{}
+	release  chan struct{}
+}
+
+func (t panickingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	t.received <- struct{}{}
+	<-t.release
+	panic("lookup failed")
+}
+
+func TestRouteCheckerReleasesWaitersOnPanic(t *testing.T) {
+	c := NewRouteChecker("http://gateway-api/route", time.Second, time.Minute, time.Minute)
+	transport := panickingTransport{received: make(chan struct{}, 1), release: make(chan struct{})}
+	c.client.Transport = transport
+
+	go func() {
+		defer func() { recover() }()
+		c.Check("c", "p")
+	}()
+	<-transport.received
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := c.Check("c", "p")
+		waiter <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(transport.release)
+
+	select {
+	case err := <-waiter:
+		if err == nil {
+			t.Fatalf("waiter: got no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiter blocked on the panicked lookup")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.calls) != 0 {
+		t.Fatalf("the panicked lookup is still in flight")
+	}
+}
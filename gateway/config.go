@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+	"go.uber.org/zap/zapcore"
+)
+
+type ListenerConfig struct {
+	HTTP string
+	GRPC string
+	// HTTPS and GRPCS, if set, serve HTTP and gRPC over TLS.
+	HTTPS string
+	GRPCS string
+	// HTTP3, if set, serves HTTP/3 over QUIC on this UDP address, which
+	// HTTPS responses advertise with an Alt-Svc header.
+	HTTP3 string
+	// Mux, if set, serves both HTTP and gRPC on a single port.
+	Mux   string
+	Admin string
+}
+
+type TLSCertificate struct {
+	Cert string
+	Key  string
+}
+
+type TLSConfig struct {
+	// Certificates are selected by the server name clients ask for, the
+	// first one is used by default.
+	Certificates []TLSCertificate
+	// ClientCA, if set, verifies client certificates. A certificate whose
+	// common name or DNS name is a project id authenticates that project.
+	ClientCA          string
+	RequireClientCert bool
+	// ReloadInterval is how often files are checked for changes.
+	ReloadInterval time.Duration
+}
+
+type ServerConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// DrainDelay is how long health checks fail before shutting down, out of
+	// ShutdownTimeout.
+	DrainDelay      time.Duration
+	ShutdownTimeout time.Duration
+}
+
+type RouteConfig struct {
+	// URL of the route lookups: http://gateway-api/route/{chain_id}/{project_id}
+	URL              string
+	Timeout          time.Duration
+	CacheTTL         time.Duration
+	CacheNegativeTTL time.Duration
+	// UsageURL, DenylistURL and EventsURL default to siblings of URL, an
+	// empty EventsURL disables route events.
+	UsageURL    string
+	DenylistURL string
+	EventsURL   string
+	// Token authenticates the gateway to the usage, denylist and events
+	// endpoints, which the gateway-api only serves with its Api.Token.
+	Token string
+	// Domains are the parent domains of host routes.
+	Domains []string
+}
+
+type UpstreamConfig struct {
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+
+	HealthCheckInterval     time.Duration
+	HealthCheckTimeout      time.Duration
+	BreakerOpenDuration     time.Duration
+	BreakerSlowCallDuration time.Duration
+}
+
+type WebsocketConfig struct {
+	ReadBufferSize          int
+	WriteBufferSize         int
+	UpstreamReadBufferSize  int
+	UpstreamWriteBufferSize int
+	HandshakeTimeout        time.Duration
+	// MaxMessageSize limits client messages in bytes, 0 for no limit.
+	MaxMessageSize int64
+}
+
+type AdminConfig struct {
+	Token string
+}
+
+type RateLimitConfig struct {
+	// Backend is memory or redis: redis://:password@host:6379/0
+	Backend  string
+	RedisURL string
+}
+
+type Config struct {
+	// LogLevel, Route cache TTLs, TrustedProxies and Admin.Token are reloaded
+	// on SIGHUP, other settings require a restart.
+	LogLevel string
+	// Services are the proxies served by the gateway: http and/or grpc.
+	Services  []string
+	Listeners ListenerConfig
+	Server    ServerConfig
+	Route     RouteConfig
+	Upstream  UpstreamConfig
+	Websocket WebsocketConfig
+	TLS       TLSConfig
+	Admin     AdminConfig
+	RateLimit RateLimitConfig
+
+	// TrustedProxies are the CIDRs whose X-Forwarded-For entries are trusted.
+	TrustedProxies          []string
+	DenylistRefreshInterval time.Duration
+}
+
+// configDefaults are the settings used when neither the config file nor the
+// environment sets them.
+var configDefaults = map[string]interface{}{
+	"loglevel":                          "info",
+	"listeners.http":                    ":80",
+	"listeners.grpc":                    ":81",
+	"listeners.https":                   "",
+	"listeners.grpcs":                   "",
+	"listeners.http3":                   "",
+	"listeners.mux":                     "",
+	"listeners.admin":                   defaultAdminAddr,
+	"server.readtimeout":                0,
+	"server.readheadertimeout":          10 * time.Second,
+	"server.writetimeout":               0,
+	"server.idletimeout":                2 * time.Minute,
+	"server.draindelay":                 5 * time.Second,
+	"server.shutdowntimeout":            30 * time.Second,
+	"services":                          []string{"http"},
+	"route.url":                         "http://gateway-api/route",
+	"route.timeout":                     1 * time.Second,
+	"route.cachettl":                    defaultRouteCacheTTL,
+	"route.cachenegativettl":            defaultRouteCacheNegativeTTL,
+	"route.domains":                     []string{},
+	"route.token":                       "",
+	"upstream.dialtimeout":              30 * time.Second,
+	"upstream.keepalive":                30 * time.Second,
+	"upstream.tlshandshaketimeout":      10 * time.Second,
+	"upstream.responseheadertimeout":    0,
+	"upstream.idleconntimeout":          90 * time.Second,
+	"upstream.maxidleconns":             100,
+	"upstream.maxidleconnsperhost":      2,
+	"upstream.maxconnsperhost":          0,
+	"upstream.healthcheckinterval":      DefaultHealthCheck.Interval,
+	"upstream.healthchecktimeout":       DefaultHealthCheck.Timeout,
+	"upstream.breakeropenduration":      DefaultCircuitBreaker.OpenDuration,
+	"upstream.breakerslowcallduration":  DefaultCircuitBreaker.SlowCallDuration,
+	"websocket.readbuffersize":          1024,
+	"websocket.writebuffersize":         1024,
+	"websocket.upstreamreadbuffersize":  1024,
+	"websocket.upstreamwritebuffersize": 1024 * 256,
+	"websocket.handshaketimeout":        45 * time.Second,
+	"websocket.maxmessagesize":          0,
+	"tls.certificates":                  []TLSCertificate{},
+	"tls.clientca":                      "",
+	"tls.requireclientcert":             false,
+	"tls.reloadinterval":                time.Minute,
+	"admin.token":                       "",
+	"ratelimit.backend":                 "memory",
+	"ratelimit.redisurl":                "",
+	"trustedproxies":                    []string{},
+	"denylistrefreshinterval":           defaultDenylistRefreshInterval,
+}
+
+// configEnv maps settings to the environment variables the gateway has
+// always been configured with. Other settings are read from GATEWAY_ and
+// their path, such as GATEWAY_SERVER_IDLETIMEOUT.
+var configEnv = map[string]string{
+	"route.url":                        "GATEWAY_API_ROUTE_URL",
+	"services":                         "GATEWAY_API_ROUTE_SERVICE",
+	"route.cachettl":                   "GATEWAY_ROUTE_CACHE_TTL",
+	"route.cachenegativettl":           "GATEWAY_ROUTE_CACHE_NEGATIVE_TTL",
+	"route.usageurl":                   "GATEWAY_API_USAGE_URL",
+	"route.denylisturl":                "GATEWAY_API_DENYLIST_URL",
+	"route.eventsurl":                  "GATEWAY_API_EVENTS_URL",
+	"route.domains":                    "GATEWAY_HTTP_DOMAINS",
+	"route.token":                      "GATEWAY_API_TOKEN",
+	"upstream.healthcheckinterval":     "GATEWAY_HEALTH_CHECK_INTERVAL",
+	"upstream.healthchecktimeout":      "GATEWAY_HEALTH_CHECK_TIMEOUT",
+	"upstream.breakeropenduration":     "GATEWAY_BREAKER_OPEN_DURATION",
+	"upstream.breakerslowcallduration": "GATEWAY_BREAKER_SLOW_CALL_DURATION",
+	"listeners.admin":                  "GATEWAY_ADMIN_ADDR",
+	"admin.token":                      "GATEWAY_ADMIN_TOKEN",
+	"ratelimit.backend":                "GATEWAY_RATE_LIMIT_BACKEND",
+	"ratelimit.redisurl":               "GATEWAY_RATE_LIMIT_REDIS_URL",
+	"trustedproxies":                   "GATEWAY_TRUSTED_PROXIES",
+	"denylistrefreshinterval":          "GATEWAY_DENYLIST_REFRESH_INTERVAL",
+}
+
+// LoadConfig reads the config file at path, or config.yaml in the working
+// directory if it exists when path is empty, applies the environment on top
+// and validates the result.
+func LoadConfig(path string) (*Config, error) {
+	v := viper.New()
+	for key, value := range configDefaults {
+		v.SetDefault(key, value)
+	}
+	v.SetEnvPrefix("GATEWAY")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	// An empty GATEWAY_API_EVENTS_URL disables route events.
+	v.AllowEmptyEnv(true)
+	for key, env := range configEnv {
+		v.BindEnv(key, env, "GATEWAY_"+strings.ToUpper(strings.ReplaceAll(key, ".", "_")))
+	}
+
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
+		v.AddConfigPath(".")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if path != "" || !errors.As(err, &notFound) {
+			return nil, err
+		}
+	}
+
+	config := &Config{}
+	if err := v.Unmarshal(config); err != nil {
+		return nil, err
+	}
+	config.Services = splitList(config.Services)
+	config.Route.Domains = splitList(config.Route.Domains)
+	config.TrustedProxies = splitList(config.TrustedProxies)
+
+	// Sibling URLs: http://gateway-api/usage, /denylist and /events
+	base := strings.TrimSuffix(config.Route.URL, "/route")
+	if !v.IsSet("route.usageurl") {
+		config.Route.UsageURL = base + "/usage"
+	}
+	if !v.IsSet("route.denylisturl") {
+		config.Route.DenylistURL = base + "/denylist"
+	}
+	if !v.IsSet("route.eventsurl") {
+		config.Route.EventsURL = base + "/events"
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate reports every invalid setting.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, err := zapcore.ParseLevel(c.LogLevel)
+	check(err == nil, "loglevel: %q is not a log level", c.LogLevel)
+	check(len(c.Services) > 0, "services: required")
+	for _, service := range c.Services {
+		check(service == "http" || service == "grpc", "services: %q is not one of http, grpc", service)
+	}
+	check(!c.serves("http") || c.Listeners.HTTP != "" || c.Listeners.Mux != "", "listeners.http: required to serve http")
+	check(!c.serves("grpc") || c.Listeners.GRPC != "" || c.Listeners.Mux != "", "listeners.grpc: required to serve grpc")
+	if c.Listeners.HTTPS != "" || c.Listeners.GRPCS != "" || c.Listeners.HTTP3 != "" {
+		check(len(c.TLS.Certificates) > 0, "tls.certificates: required by the TLS listeners")
+	}
+	check(c.Listeners.HTTP3 == "" || c.serves("http"), "listeners.http3: requires the http service")
+	for i, pair := range c.TLS.Certificates {
+		check(pair.Cert != "" && pair.Key != "", "tls.certificates[%d]: cert and key required", i)
+	}
+	for key, value := range map[string]string{
+		"route.url":         c.Route.URL,
+		"route.usageurl":    c.Route.UsageURL,
+		"route.denylisturl": c.Route.DenylistURL,
+		"route.eventsurl":   c.Route.EventsURL,
+	} {
+		if value == "" && key != "route.url" {
+			continue
+		}
+		u, err := url.Parse(value)
+		check(err == nil && u.Scheme != "" && u.Host != "", "%s: %q is not a URL", key, value)
+	}
+	check(c.RateLimit.Backend == "memory" || c.RateLimit.Backend == "redis", "ratelimit.backend: %q is not one of memory, redis", c.RateLimit.Backend)
+	check(c.RateLimit.Backend != "redis" || c.RateLimit.RedisURL != "", "ratelimit.redisurl: required by the redis backend")
+	if c.RateLimit.Backend == "redis" && c.RateLimit.RedisURL != "" {
+		_, err := redis.ParseURL(c.RateLimit.RedisURL)
+		check(err == nil, "ratelimit.redisurl: %q is not a Redis URL", c.RateLimit.RedisURL)
+	}
+	for _, proxy := range c.TrustedProxies {
+		check(len(parsePrefixes([]string{proxy})) == 1, "trustedproxies: %q is not an IP or CIDR", proxy)
+	}
+
+	// Durations of zero disable the corresponding timeout.
+	for key, d := range map[string]time.Duration{
+		"server.readtimeout":             c.Server.ReadTimeout,
+		"server.readheadertimeout":       c.Server.ReadHeaderTimeout,
+		"server.writetimeout":            c.Server.WriteTimeout,
+		"server.idletimeout":             c.Server.IdleTimeout,
+		"server.draindelay":              c.Server.DrainDelay,
+		"server.shutdowntimeout":         c.Server.ShutdownTimeout,
+		"upstream.dialtimeout":           c.Upstream.DialTimeout,
+		"upstream.keepalive":             c.Upstream.KeepAlive,
+		"upstream.tlshandshaketimeout":   c.Upstream.TLSHandshakeTimeout,
+		"upstream.responseheadertimeout": c.Upstream.ResponseHeaderTimeout,
+		"upstream.idleconntimeout":       c.Upstream.IdleConnTimeout,
+		"websocket.handshaketimeout":     c.Websocket.HandshakeTimeout,
+		"tls.reloadinterval":             c.TLS.ReloadInterval,
+	} {
+		check(d >= 0, "%s: must not be negative", key)
+	}
+	for key, d := range map[string]time.Duration{
+		"route.timeout":                    c.Route.Timeout,
+		"route.cachettl":                   c.Route.CacheTTL,
+		"route.cachenegativettl":           c.Route.CacheNegativeTTL,
+		"upstream.healthcheckinterval":     c.Upstream.HealthCheckInterval,
+		"upstream.healthchecktimeout":      c.Upstream.HealthCheckTimeout,
+		"upstream.breakeropenduration":     c.Upstream.BreakerOpenDuration,
+		"upstream.breakerslowcallduration": c.Upstream.BreakerSlowCallDuration,
+		"denylistrefreshinterval":          c.DenylistRefreshInterval,
+	} {
+		check(d > 0, "%s: must be positive", key)
+	}
+	for key, n := range map[string]int{
+		"upstream.maxidleconns":             c.Upstream.MaxIdleConns,
+		"upstream.maxidleconnsperhost":      c.Upstream.MaxIdleConnsPerHost,
+		"upstream.maxconnsperhost":          c.Upstream.MaxConnsPerHost,
+		"websocket.readbuffersize":          c.Websocket.ReadBufferSize,
+		"websocket.writebuffersize":         c.Websocket.WriteBufferSize,
+		"websocket.upstreamreadbuffersize":  c.Websocket.UpstreamReadBufferSize,
+		"websocket.upstreamwritebuffersize": c.Websocket.UpstreamWriteBufferSize,
+		"websocket.maxmessagesize":          int(c.Websocket.MaxMessageSize),
+	} {
+		check(n >= 0, "%s: must not be negative", key)
+	}
+	return errors.Join(errs...)
+}
+
+// serves reports whether the gateway serves the service.
+func (c *Config) serves(service string) bool {
+	for _, s := range c.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Reloadable reports whether next only differs from c in settings that are
+// applied on SIGHUP.
+func (c *Config) Reloadable(next *Config) bool {
+	return reflect.DeepEqual(*c.Reloaded(next), *next)
+}
+
+// Reloaded returns a copy of c with the settings of next that are applied on
+// SIGHUP, that is the configuration in effect after a reload.
+func (c *Config) Reloaded(next *Config) *Config {
+	applied := *c
+	applied.LogLevel = next.LogLevel
+	applied.Route.CacheTTL, applied.Route.CacheNegativeTTL = next.Route.CacheTTL, next.Route.CacheNegativeTTL
+	applied.TrustedProxies = next.TrustedProxies
+	applied.Admin.Token = next.Admin.Token
+	return &applied
+}
+
+// splitList splits comma separated entries, as given by environment
+// variables, and drops empty ones.
+func splitList(values []string) []string {
+	list := []string{}
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+				list = append(list, entry)
+			}
+		}
+	}
+	return list
+}
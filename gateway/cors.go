@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultCORSMaxAge = 600
+
+// Headers browsers may always send and read.
+var (
+	corsAllowHeaders  = []string{"Content-Type", "Authorization", projectSecretHeader}
+	corsExposeHeaders = []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After", "X-Quota-Warning"}
+)
+
+// RouteCORS is the CORS policy of a project, on top of the headers the
+// gateway itself needs. The allowed origins are the project's origins.
+type RouteCORS struct {
+	AllowHeaders     []string `json:"allow_headers"`
+	ExposeHeaders    []string `json:"expose_headers"`
+	MaxAge           int      `json:"max_age"`
+	AllowCredentials bool     `json:"allow_credentials"`
+}
+
+// isPreflight reports whether req is a CORS preflight request.
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setCORSHeaders sets the Access-Control-* headers of a response to a
+// browser request from an allowed origin. Only projects with an origin
+// allowlist, which the origin has matched, get the origin echoed and may
+// allow credentials; others answer any origin with *.
+func setCORSHeaders(h http.Header, req *http.Request, cors RouteCORS, origins []string) {
+	origin := req.Header.Get("Origin")
+	h.Add("Vary", "Origin")
+	if origin == "" {
+		return
+	}
+	if len(origins) > 0 {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if !isPreflight(req) {
+		h.Set("Access-Control-Expose-Headers", strings.Join(append(corsExposeHeaders, cors.ExposeHeaders...), ", "))
+		return
+	}
+
+	maxAge := cors.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultCORSMaxAge
+	}
+	h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", strings.Join(append(corsAllowHeaders, cors.AllowHeaders...), ", "))
+	h.Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+}
+
+// stripCORSHeaders removes the upstream's own CORS headers, the gateway's
+// are set on the response writer beforehand.
+func stripCORSHeaders(resp *http.Response) error {
+	for key := range resp.Header {
+		if strings.HasPrefix(key, "Access-Control-") {
+			resp.Header.Del(key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetCORSHeaders(t *testing.T) {
+	origins := []string{"https://app.example.com"}
+	credentials := RouteCORS{AllowCredentials: true, ExposeHeaders: []string{"X-Custom"}}
+
+	for _, test := range []struct {
+		name        string
+		origin      string
+		cors        RouteCORS
+		origins     []string
+		allow       string
+		credentials string
+	}{
+		{"allowlisted origin", "https://app.example.com", credentials, origins, "https://app.example.com", "true"},
+		{"allowlisted origin without credentials", "https://app.example.com", RouteCORS{}, origins, "https://app.example.com", ""},
+		// Without an allowlist any origin may call, but never with credentials.
+		{"no allowlist", "https://evil.example.com", credentials, nil, "*", ""},
+		{"no origin", "", credentials, origins, "", ""},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/rpc/c/p", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		h := http.Header{}
+		setCORSHeaders(h, req, test.cors, test.origins)
+
+		if got := h.Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", test.name, got, test.allow)
+		}
+		if got := h.Get("Access-Control-Allow-Credentials"); got != test.credentials {
+			t.Errorf("%s: got Access-Control-Allow-Credentials %q, want %q", test.name, got, test.credentials)
+		}
+		if got := h.Get("Vary"); got != "Origin" {
+			t.Errorf("%s: got Vary %q, want Origin", test.name, got)
+		}
+		if test.origin != "" && h.Get("Access-Control-Allow-Methods") != "" {
+			t.Errorf("%s: preflight headers set on a simple request", test.name)
+		}
+	}
+}
+
+func TestSetCORSHeadersPreflight(t *testing.T) {
+	req := httptest.NewRequest(http.MethodOptions, "/rpc/c/p", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	if !isPreflight(req) {
+		t.Fatal("not a preflight")
+	}
+
+	h := http.Header{}
+	setCORSHeaders(h, req, RouteCORS{AllowHeaders: []string{"X-Custom"}}, nil)
+	for key, want := range map[string]string{
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Allow-Methods":  "GET, POST, OPTIONS",
+		"Access-Control-Allow-Headers":  "Content-Type, Authorization, " + projectSecretHeader + ", X-Custom",
+		"Access-Control-Max-Age":        "600",
+		"Access-Control-Expose-Headers": "",
+	} {
+		if got := h.Get(key); got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+}
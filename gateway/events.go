@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	routeEventsMinBackoff = time.Second
+	routeEventsMaxBackoff = 30 * time.Second
+	// routeEventsIdleTimeout is three keep-alive intervals of the API,
+	// after which the stream is considered dead and reconnected.
+	routeEventsIdleTimeout = 45 * time.Second
+)
+
+// RouteEvent tells that the routes of a chain and/or a project have changed.
+// An empty chain or project matches any, so an event with neither evicts
+// every route.
+type RouteEvent struct {
+	ID      int64  `json:"id"`
+	Chain   string `json:"chain"`
+	Project string `json:"project"`
+}
+
+// RouteEvents subscribes to the route events the gateway-api publishes as
+// server-sent events and hands them to evict. Events missed while
+// disconnected are replayed from the last event id on reconnection.
+type RouteEvents struct {
+	url    string
+	client *http.Client
+	evict  func(chain, project string)
+	lastID int64
+}
+
+func NewRouteEvents(url, token string, evict func(chain, project string)) *RouteEvents {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = routeEventsIdleTimeout
+	return &RouteEvents{
+		url: url,
+		// Streams stay open, idle ones are timed out by subscribe.
+		client: &http.Client{Transport: apiTransport{transport, token}},
+		evict:  evict,
+	}
+}
+
+// Run subscribes until the process exits, reconnecting with backoff.
+func (e *RouteEvents) Run() {
+	backoff := routeEventsMinBackoff
+	for {
+		connected, err := e.subscribe()
+		if connected {
+			backoff = routeEventsMinBackoff
+		}
+		zap.S().Errorw(fmt.Sprintf("events: subscription ended | %v", err))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > routeEventsMaxBackoff {
+			backoff = routeEventsMaxBackoff
+		}
+	}
+}
+
+func (e *RouteEvents) subscribe() (bool, error) {
+	// Events URL: http://gateway-api/events
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if e.lastID > 0 {
+		req.Header.Set("Last-Event-ID", fmt.Sprint(e.lastID))
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	// Routes cached before the first subscription may already be stale.
+	if e.lastID == 0 {
+		e.evict("", "")
+	}
+	zap.S().Infow("events", "url", e.url, "last", e.lastID)
+
+	// The API sends keep-alive comments, a silent stream is a dead one.
+	idle := time.AfterFunc(routeEventsIdleTimeout, cancel)
+	defer idle.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(routeEventsIdleTimeout)
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var event RouteEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			zap.S().Errorw(fmt.Sprintf("events: couldn't parse event | %s", err))
+			continue
+		}
+		zap.S().Infow("events", "id", event.ID, "chain", event.Chain, "project", event.Project)
+		e.evict(event.Chain, event.Project)
+		// Events committed late are sent again with lower ids.
+		if event.ID > e.lastID {
+			e.lastID = event.ID
+		}
+	}
+	if ctx.Err() != nil {
+		return true, fmt.Errorf("no data for %s", routeEventsIdleTimeout)
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, fmt.Errorf("stream closed")
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Gateway runs the HTTP and gRPC proxies of one process. They share the
+// route cache, rate limits, quotas and IP filter, and may also be served on
+// a single port that tells them apart by sniffing every connection.
+type Gateway struct {
+	// cfg is the configuration in effect, updated by Reload.
+	cfg      atomic.Pointer[Config]
+	checker  *RouteChecker
+	ipFilter *IPFilter
+	router   *Router
+	grpcPool *GrpcConnectionPool
+	health   *HealthServer
+	admin    *Admin
+	certs    *CertStore
+
+	httpServer  *http.Server
+	http3Server *http3.Server
+	grpcServer  *grpc.Server
+	// grpcTLSServer serves GRPCS, as gRPC servers are either encrypted or
+	// not.
+	grpcTLSServer *grpc.Server
+	adminServer   *http.Server
+	mux           cmux.CMux
+
+	closing atomic.Bool
+}
+
+func NewGateway(cfg *Config) (*Gateway, error) {
+	backend, err := newRateLimitBackend(cfg.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	checker := NewRouteChecker(cfg.Route.URL, cfg.Route.Timeout, cfg.Route.CacheTTL, cfg.Route.CacheNegativeTTL)
+	limiter := NewRateLimiter(backend)
+	quotas := NewQuotaTracker(cfg.Route.UsageURL, cfg.Route.Token)
+	ipFilter := NewIPFilter(cfg.Route.DenylistURL, cfg.Route.Token, parsePrefixes(cfg.TrustedProxies), cfg.DenylistRefreshInterval)
+
+	g := &Gateway{checker: checker, ipFilter: ipFilter}
+	g.cfg.Store(cfg)
+	if cfg.Listeners.HTTPS != "" || cfg.Listeners.GRPCS != "" || cfg.Listeners.HTTP3 != "" {
+		certs, err := NewCertStore(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		g.certs = certs
+	}
+	if cfg.serves("http") {
+		// Host routes: {project}.{chain}.gateway.example, {chain}.gateway.example/{project}
+		hosts := &HostRoutes{Domains: cfg.Route.Domains}
+		g.router = NewRouter(checker, limiter, quotas, ipFilter, hosts)
+		handler := http.Handler(g.router)
+		if cfg.Listeners.HTTP3 != "" {
+			g.http3Server = &http3.Server{Handler: g.router, TLSConfig: g.certs.Config()}
+			handler = advertiseHTTP3(handler, g.http3Server)
+		}
+		// Cleartext listeners also accept HTTP/2, by upgrade or prior
+		// knowledge, so that clients can multiplex their requests.
+		h2 := &http2.Server{IdleTimeout: cfg.Server.IdleTimeout}
+		g.httpServer = &http.Server{
+			Handler:           h2c.NewHandler(handler, h2),
+			ReadTimeout:       cfg.Server.ReadTimeout,
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+			WriteTimeout:      cfg.Server.WriteTimeout,
+			IdleTimeout:       cfg.Server.IdleTimeout,
+		}
+		// Shares h2 with the TLS listeners, and sends GOAWAY to HTTP/2
+		// connections on Shutdown.
+		if err := http2.ConfigureServer(g.httpServer, h2); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.serves("grpc") {
+		g.grpcPool = NewGrpcConnectionPool()
+		g.health = &HealthServer{}
+		g.grpcServer = buildGrpcProxyServer(checker, limiter, quotas, ipFilter, g.grpcPool, g.health)
+		if cfg.Listeners.GRPCS != "" {
+			g.grpcTLSServer = buildGrpcProxyServer(checker, limiter, quotas, ipFilter, g.grpcPool, g.health,
+				grpc.Creds(credentials.NewTLS(g.certs.Config())))
+		}
+	}
+	g.admin = NewAdmin(cfg.Admin.Token, checker, g.Evict, g.Upstreams)
+	if g.grpcPool != nil {
+		g.admin.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_grpc_pool_connections",
+			Help: "Connections of the gRPC proxy to upstreams.",
+		}, func() float64 { return float64(g.grpcPool.Size()) }))
+	}
+	return g, nil
+}
+
+// Evict drops the cached routes, and the proxies of evicted chains, of a
+// chain and/or a project.
+func (g *Gateway) Evict(chain, project string) {
+	if g.router != nil {
+		g.router.Evict(chain, project)
+	} else {
+		g.checker.Evict(chain, project)
+	}
+}
+
+// Upstreams describes the upstreams of the HTTP and gRPC proxies.
+func (g *Gateway) Upstreams() []AdminUpstream {
+	upstreams := []AdminUpstream{}
+	if g.router != nil {
+		upstreams = append(upstreams, g.router.Upstreams()...)
+	}
+	if g.grpcPool != nil {
+		upstreams = append(upstreams, g.grpcPool.Upstreams()...)
+	}
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return upstreams[i].Chain < upstreams[j].Chain
+	})
+	return upstreams
+}
+
+// Serve opens every listener and serves them in the background. Errors of
+// listeners that stop before Shutdown is called are sent on the returned
+// channel.
+func (g *Gateway) Serve() (<-chan error, error) {
+	cfg := g.cfg.Load()
+	errc := make(chan error, 8)
+	serve := func(name string, fn func() error) {
+		go func() {
+			if err := fn(); err != nil && !g.closing.Load() {
+				errc <- fmt.Errorf("%s: %w", name, err)
+			}
+		}()
+	}
+	listen := func(name, addr string) (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			log.Printf("Starting %s server on %s...", name, addr)
+		}
+		return l, err
+	}
+
+	if g.httpServer != nil && cfg.Listeners.HTTP != "" {
+		l, err := listen("HTTP", cfg.Listeners.HTTP)
+		if err != nil {
+			return nil, err
+		}
+		serve("http", func() error { return g.httpServer.Serve(l) })
+	}
+	if g.grpcServer != nil && cfg.Listeners.GRPC != "" {
+		l, err := listen("gRPC", cfg.Listeners.GRPC)
+		if err != nil {
+			return nil, err
+		}
+		serve("grpc", func() error { return g.grpcServer.Serve(l) })
+	}
+	if g.httpServer != nil && cfg.Listeners.HTTPS != "" {
+		l, err := listen("HTTPS", cfg.Listeners.HTTPS)
+		if err != nil {
+			return nil, err
+		}
+		serve("https", func() error { return g.httpServer.Serve(tls.NewListener(l, g.certs.Config())) })
+	}
+	if g.http3Server != nil {
+		conn, err := net.ListenPacket("udp", cfg.Listeners.HTTP3)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Starting HTTP/3 server on %s...", cfg.Listeners.HTTP3)
+		serve("http3", func() error { return g.http3Server.Serve(conn) })
+	}
+	if g.grpcTLSServer != nil {
+		l, err := listen("gRPC TLS", cfg.Listeners.GRPCS)
+		if err != nil {
+			return nil, err
+		}
+		serve("grpcs", func() error { return g.grpcTLSServer.Serve(l) })
+	}
+	if cfg.Listeners.Mux != "" {
+		l, err := listen("multiplexed", cfg.Listeners.Mux)
+		if err != nil {
+			return nil, err
+		}
+		g.mux = cmux.New(l)
+		// gRPC clients wait for the server's settings before sending their
+		// headers, so they must be answered while sniffing.
+		if g.grpcServer != nil {
+			grpcListener := g.mux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+			serve("mux grpc", func() error { return g.grpcServer.Serve(grpcListener) })
+		}
+		if g.httpServer != nil {
+			httpListener := g.mux.Match(cmux.Any())
+			serve("mux http", func() error { return g.httpServer.Serve(httpListener) })
+		}
+		serve("mux", g.mux.Serve)
+	}
+
+	if cfg.Admin.Token == "" {
+		log.Println("Admin endpoints other than /metrics disabled, Admin.Token (GATEWAY_ADMIN_TOKEN) is required")
+	}
+	if cfg.Listeners.Admin != "" {
+		l, err := listen("admin", cfg.Listeners.Admin)
+		if err != nil {
+			return nil, err
+		}
+		g.adminServer = &http.Server{Handler: g.admin}
+		serve("admin", func() error { return g.adminServer.Serve(l) })
+	}
+
+	if cfg.Route.EventsURL != "" {
+		go NewRouteEvents(cfg.Route.EventsURL, cfg.Route.Token, g.Evict).Run()
+	}
+	return errc, nil
+}
+
+// Shutdown first fails the health checks for Server.DrainDelay so that load
+// balancers stop sending new clients. It then stops accepting connections,
+// tells WebSocket clients to reconnect elsewhere and waits for in-flight
+// HTTP requests, gRPC calls and WebSocket sessions to finish until ctx is
+// done, then closes the remaining ones. HTTP/3 connections are closed last,
+// as QUIC servers cannot wait for their requests yet.
+func (g *Gateway) Shutdown(ctx context.Context) {
+	g.closing.Store(true)
+
+	if g.router != nil {
+		g.router.Drain()
+	}
+	if g.health != nil {
+		g.health.Drain()
+	}
+	select {
+	case <-time.After(g.cfg.Load().Server.DrainDelay):
+	case <-ctx.Done():
+	}
+
+	var wg sync.WaitGroup
+	if g.httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			DefaultSessions.Close(ctx, websocket.CloseServiceRestart, "service restart")
+		}()
+	}
+	if g.httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g.httpServer.Shutdown(ctx); err != nil {
+				zap.S().Errorw(fmt.Sprintf("shutdown: http | %s", err))
+				g.httpServer.Close()
+			}
+		}()
+	}
+	for _, server := range []*grpc.Server{g.grpcServer, g.grpcTLSServer} {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(server *grpc.Server) {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				server.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				zap.S().Errorw(fmt.Sprintf("shutdown: grpc | %s", ctx.Err()))
+				server.Stop()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	if g.http3Server != nil {
+		g.http3Server.Close()
+	}
+	if g.mux != nil {
+		g.mux.Close()
+	}
+	if g.adminServer != nil {
+		g.adminServer.Close()
+	}
+}
+
+// advertiseHTTP3 announces the HTTP/3 listener in the responses of the
+// HTTPS listener.
+func advertiseHTTP3(next http.Handler, server *http3.Server) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			server.SetQuicHeaders(rw.Header())
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Reload applies the settings of next that are safe to change at runtime.
+// Other changes are only logged, they take effect on restart.
+func (g *Gateway) Reload(next *Config) {
+	cfg := g.cfg.Load()
+	if !cfg.Reloadable(next) {
+		zap.S().Warnw("config: some changes require a restart")
+	}
+	logLevel.UnmarshalText([]byte(next.LogLevel))
+	g.checker.SetTTL(next.Route.CacheTTL, next.Route.CacheNegativeTTL)
+	g.ipFilter.SetTrusted(parsePrefixes(next.TrustedProxies))
+	g.admin.SetToken(next.Admin.Token)
+	if g.certs != nil {
+		if err := g.certs.Reload(); err != nil {
+			zap.S().Errorw(fmt.Sprintf("tls: reload failed | %s", err))
+		}
+	}
+	g.cfg.Store(cfg.Reloaded(next))
+	zap.S().Infow("config: reloaded", "loglevel", next.LogLevel)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	testRpcPath    = "/rpc/testchain/aaaaaaaaaaaaaaaa"
+	testRpcRequest = `{"jsonrpc":"2.0","id":1,"method":"chain_getBlock"}`
+	testRpcResult  = `{"jsonrpc":"2.0","id":1,"result":"0x1"}`
+)
+
+// testGateway serves the JSON-RPC listeners of a Gateway routing every
+// project to a fake node.
+type testGateway struct {
+	httpAddr  string
+	http3Addr string
+	roots     *x509.CertPool
+}
+
+func newTestGateway(t *testing.T) *testGateway {
+	t.Helper()
+	node := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		io.WriteString(rw, testRpcResult)
+	}))
+	t.Cleanup(node.Close)
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/route/") {
+			http.NotFound(rw, req)
+			return
+		}
+		resp := &RouteResponse{Route: true}
+		resp.Target.RPC = node.URL
+		json.NewEncoder(rw).Encode(resp)
+	}))
+	t.Cleanup(api.Close)
+
+	dir := t.TempDir()
+	roots := writeTestCertificate(t, dir)
+	config := fmt.Sprintf(`
+Services: [http]
+Listeners:
+  HTTP: 127.0.0.1:0
+  HTTP3: 127.0.0.1:0
+Route:
+  URL: %s/route
+  EventsURL: ""
+TLS:
+  Certificates:
+    - Cert: %s
+      Key: %s
+`, api.URL, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGateway(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.httpServer.Serve(l)
+	t.Cleanup(func() { g.httpServer.Close() })
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.http3Server.Serve(conn)
+	t.Cleanup(func() {
+		g.http3Server.Close()
+		conn.Close()
+	})
+	return &testGateway{httpAddr: l.Addr().String(), http3Addr: conn.LocalAddr().String(), roots: roots}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 to
+// dir and returns a pool trusting it.
+func writeTestCertificate(t *testing.T, dir string) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	return roots
+}
+
+func checkRpcResponse(t *testing.T, resp *http.Response, protoMajor int) {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != protoMajor || resp.StatusCode != http.StatusOK || string(body) != testRpcResult {
+		t.Fatalf("got %s %d %q, want HTTP/%d 200 %q", resp.Proto, resp.StatusCode, body, protoMajor, testRpcResult)
+	}
+}
+
+func TestGatewayHTTP2PriorKnowledge(t *testing.T) {
+	g := newTestGateway(t)
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	resp, err := client.Post("http://"+g.httpAddr+testRpcPath, "application/json", strings.NewReader(testRpcRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRpcResponse(t, resp, 2)
+}
+
+func TestGatewayHTTP2Upgrade(t *testing.T) {
+	g := newTestGateway(t)
+	conn, err := net.Dial("tcp", g.httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// The upgraded request is answered on stream 1 of the HTTP/2 connection.
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
+		testRpcPath, g.httpAddr, len(testRpcRequest), testRpcRequest)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+	io.WriteString(conn, http2.ClientPreface)
+	framer := http2.NewFramer(conn, br)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	var status string
+	var body bytes.Buffer
+	decoder := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		if f.Name == ":status" {
+			status = f.Value
+		}
+	})
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			if _, err := decoder.Write(f.HeaderBlockFragment()); err != nil {
+				t.Fatal(err)
+			}
+		case *http2.DataFrame:
+			body.Write(f.Data())
+		case *http2.GoAwayFrame:
+			t.Fatalf("got GOAWAY %v", f.ErrCode)
+		}
+		if frame.Header().StreamID == 1 && frame.Header().Flags.Has(http2.FlagDataEndStream) {
+			break
+		}
+	}
+	if status != "200" || body.String() != testRpcResult {
+		t.Fatalf("got %s %q, want 200 %q", status, body.String(), testRpcResult)
+	}
+}
+
+func TestGatewayHTTP3(t *testing.T) {
+	g := newTestGateway(t)
+	transport := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: g.roots}}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Post("https://"+g.http3Addr+testRpcPath, "application/json", strings.NewReader(testRpcRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRpcResponse(t, resp, 3)
+}
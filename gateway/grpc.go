@@ -2,29 +2,158 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mwitkow/grpc-proxy/proxy"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
-const prefixPathKey = "x-tls-sni-hostname"
+const (
+	prefixPathKey = "x-tls-sni-hostname"
+	// grpcRetireInterval is how often the connections of replaced upstreams
+	// are checked for calls in flight.
+	grpcRetireInterval = time.Second
+)
 
 type GrpcConnectionPool struct {
-	mu    sync.Mutex
-	conns map[string]*grpc.ClientConn
+	mu        sync.Mutex
+	conns     map[string]*grpc.ClientConn
+	upstreams map[string]*UpstreamPool
+	// fetched is when the lookup each chain's pool was built from was
+	// fetched, so that routes cached longer don't bring back old upstreams.
+	fetched map[string]time.Time
+}
+
+type grpcCallKey struct{}
+
+// grpcCall records the upstream a proxied call was sent to, so that it can
+// be released once the stream finishes.
+type grpcCall struct {
+	chain    string
+	upstream *Upstream
+	release  func()
+}
+
+// grpcServerStream overrides the context of a grpc.ServerStream.
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func NewGrpcConnectionPool() *GrpcConnectionPool {
+	return &GrpcConnectionPool{
+		conns:     make(map[string]*grpc.ClientConn),
+		upstreams: make(map[string]*UpstreamPool),
+		fetched:   make(map[string]time.Time),
+	}
+}
+
+// pick returns a connection to one of the chain's gRPC upstreams. The pool
+// of upstreams is rebuilt when a lookup more recent than the one it was
+// built from reports different ones.
+func (p *GrpcConnectionPool) pick(ctx context.Context, chain string, routeResp *RouteResponse) (*Upstream, *grpc.ClientConn, error) {
+	targets := routeResp.Targets("grpc")
+
+	p.mu.Lock()
+	upstreams, ok := p.upstreams[chain]
+	if !ok || (routeResp.fetched.After(p.fetched[chain]) && !sameTargets(upstreams, routeResp.Balancer, targets)) {
+		old := upstreams
+		upstreams = NewUpstreamPool(routeResp.Balancer, targets)
+		if old != nil {
+			upstreams.inherit(old)
+			old.Close()
+		}
+		upstreams.StartHealthChecks(GrpcProbe(p.getOrCreateConn))
+		p.upstreams[chain] = upstreams
+		p.fetched[chain] = routeResp.fetched
+		if old != nil {
+			for _, u := range old.Upstreams {
+				go p.retire(u)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	upstream := upstreams.Pick()
+	if upstream == nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "No Upstream Available")
+	}
+	conn, err := p.getOrCreateConn(ctx, upstream.Target)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "Upstream Unavailable: %s", err)
+	}
+	return upstream, conn, nil
+}
+
+// retire closes the connection of an upstream that was replaced, once its
+// calls have finished, unless another pool still uses its target. Calls
+// picked just before the replacement are given one interval to start.
+func (p *GrpcConnectionPool) retire(u *Upstream) {
+	ticker := time.NewTicker(grpcRetireInterval)
+	defer ticker.Stop()
+	<-ticker.C
+	for u.Outstanding() > 0 {
+		<-ticker.C
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pool := range p.upstreams {
+		for _, other := range pool.Upstreams {
+			if other.Target == u.Target {
+				return
+			}
+		}
+	}
+	if conn, ok := p.conns[u.Target]; ok {
+		delete(p.conns, u.Target)
+		conn.Close()
+	}
+}
+
+// Upstreams describes the gRPC upstreams of every chain.
+func (p *GrpcConnectionPool) Upstreams() []AdminUpstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	upstreams := []AdminUpstream{}
+	for chain, pool := range p.upstreams {
+		upstreams = append(upstreams, adminUpstreams(chain, "grpc", pool)...)
+	}
+	sort.Slice(upstreams, func(i, j int) bool {
+		if upstreams[i].Chain != upstreams[j].Chain {
+			return upstreams[i].Chain < upstreams[j].Chain
+		}
+		return upstreams[i].Target < upstreams[j].Target
+	})
+	return upstreams
+}
+
+// Size returns the number of connections to upstreams.
+func (p *GrpcConnectionPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
 }
 
 func (p *GrpcConnectionPool) getOrCreateConn(ctx context.Context, target string) (*grpc.ClientConn, error) {
@@ -45,14 +174,13 @@ func (p *GrpcConnectionPool) getOrCreateConn(ctx context.Context, target string)
 }
 
 // Creates a gRPC server that acts as a proxy and routes incoming requests.
-func buildGrpcProxyServer(routeChecker string) *grpc.Server {
-	pool := &GrpcConnectionPool{
-		conns: make(map[string]*grpc.ClientConn),
-	}
-
+func buildGrpcProxyServer(routeChecker *RouteChecker, limiter *RateLimiter, quotas *QuotaTracker, ipFilter *IPFilter, pool *GrpcConnectionPool, health *HealthServer, opts ...grpc.ServerOption) *grpc.Server {
 	director := func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error) {
 		md, ok := metadata.FromIncomingContext(ctx)
-		outCtx := metadata.NewOutgoingContext(ctx, md.Copy())
+		out := md.Copy()
+		out.Delete(projectSecretKey)
+		out.Delete("authorization")
+		outCtx := metadata.NewOutgoingContext(ctx, out)
 		if !ok {
 			zap.S().Errorw("grpc: metadata required")
 			return nil, nil, status.Errorf(codes.InvalidArgument, "Metadata Required")
@@ -62,61 +190,166 @@ func buildGrpcProxyServer(routeChecker string) *grpc.Server {
 			return nil, nil, status.Errorf(codes.InvalidArgument, "Prefix Path Required")
 		}
 
+		var remoteAddr string
+		if p, ok := peer.FromContext(ctx); ok {
+			remoteAddr = p.Addr.String()
+		}
+		clientIP := ipFilter.ClientIP(remoteAddr, md.Get("x-forwarded-for"))
+		if ipFilter.Denied(clientIP) {
+			zap.S().Errorw("grpc", "statue", http.StatusForbidden, "ip", clientIP)
+			return nil, nil, status.Errorf(codes.PermissionDenied, "Client IP Denied")
+		}
+
 		prefixPath := md.Get(prefixPathKey)[0]
-		target, err := shouldRoute(routeChecker, prefixPath)
+		chain, project, routeResp, err := shouldRoute(routeChecker, prefixPath)
 		if err != nil {
 			zap.S().Errorw(fmt.Sprintf("grpc: route failed %s | %s", prefixPath, err))
 			return nil, nil, status.Errorf(codes.Aborted, "Route Failed")
 		}
+		if !routeResp.IPs.Allowed(clientIP) {
+			zap.S().Errorw("grpc", "path", prefixPath, "statue", http.StatusForbidden, "ip", clientIP)
+			return nil, nil, status.Errorf(codes.PermissionDenied, "Client IP %s Not Allowed", clientIP)
+		}
+		_, err = routeResp.Auth.authenticate(firstValue(md, projectSecretKey), grpcAccessToken(md), chain, project)
+		if err != nil && clientCertProject(grpcTLSState(ctx), project) {
+			err = nil
+		}
+		if err != nil {
+			zap.S().Errorw("grpc", "path", prefixPath, "statue", http.StatusUnauthorized, "error", err)
+			return nil, nil, status.Errorf(codes.Unauthenticated, "Unauthenticated: %s", err)
+		}
+		if result := limiter.Check(ctx, chain, project, routeResp.Limits); !result.Allowed {
+			zap.S().Errorw("grpc", "path", prefixPath, "statue", http.StatusTooManyRequests)
+			return nil, nil, status.Errorf(codes.ResourceExhausted, "Rate Limit Exceeded")
+		}
+		if quota := quotas.Check(project, routeResp); quota != nil {
+			if quota.exceeded {
+				zap.S().Errorw("grpc", "path", prefixPath, "statue", http.StatusTooManyRequests, "quota", quota.Period)
+				return nil, nil, status.Errorf(codes.ResourceExhausted, "Quota Exceeded: %s", quota)
+			}
+			grpc.SetHeader(ctx, metadata.Pairs("x-quota-warning", quota.String()))
+		}
 
-		conn, err := pool.getOrCreateConn(ctx, target)
+		upstream, conn, err := pool.pick(ctx, chain, routeResp)
 		if err != nil {
-			zap.S().Errorw(fmt.Sprintf("grpc: couldn't dial to %s | %s", target, err))
+			zap.S().Errorw(fmt.Sprintf("grpc: couldn't dial to %s | %s", chain, err))
+			return nil, nil, err
 		}
-		return outCtx, conn, err
+		if call, ok := ctx.Value(grpcCallKey{}).(*grpcCall); ok {
+			call.chain, call.upstream, call.release = chain, upstream, upstream.acquire()
+		}
+		zap.S().Infow("grpc", "path", prefixPath, "target", upstream.Target)
+		return outCtx, conn, nil
 	}
 
-	server := grpc.NewServer(
+	// Track the upstream of every call for the duration of its stream.
+	interceptor := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		call, ts := &grpcCall{}, time.Now()
+		err := handler(srv, &grpcServerStream{ss, context.WithValue(ss.Context(), grpcCallKey{}, call)})
+		if call.upstream == nil && err != nil {
+			unroutedTotal.WithLabelValues("grpc", status.Code(err).String()).Inc()
+		}
+		if call.upstream != nil {
+			code := status.Code(err)
+			observeRequest(call.chain, "grpc", grpcMethodLabel(info.FullMethod, code), code.String(), time.Since(ts))
+			// Streams may legitimately stay open for long, so only the
+			// outcome of the call is reported.
+			switch status.Code(err) {
+			case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+				call.upstream.Report(true, 0)
+			default:
+				call.upstream.Report(false, 0)
+			}
+			call.release()
+		}
+		return err
+	}
+
+	server := grpc.NewServer(append([]grpc.ServerOption{
 		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)),
-	)
-	grpc_health_v1.RegisterHealthServer(server, &HealthServer{})
+		grpc.StreamInterceptor(interceptor),
+	}, opts...)...)
+	grpc_health_v1.RegisterHealthServer(server, health)
 	return server
 }
 
-func shouldRoute(routeChecker, prefixPath string) (string, error) {
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcTLSState returns the TLS state of the connection of a call, nil when
+// it isn't encrypted.
+func grpcTLSState(ctx context.Context) *tls.ConnectionState {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			return &info.State
+		}
+	}
+	return nil
+}
+
+// grpcAccessToken returns the bearer token of the authorization metadata.
+func grpcAccessToken(md metadata.MD) string {
+	if auth := firstValue(md, "authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+func shouldRoute(routeChecker *RouteChecker, prefixPath string) (string, string, *RouteResponse, error) {
 	re := regexp.MustCompile(`^(?P<project>[a-z0-9]{32}|[a-z0-9]{16})\.(?P<chain>[a-z][-a-z0-9]*[a-z0-9]?)\..+$`)
 	params := re.FindStringSubmatch(prefixPath)
 	if len(params) < 3 {
 		zap.S().Errorw("grpc", "path", prefixPath, "statue", http.StatusBadRequest)
-		return "", errors.New(http.StatusText(http.StatusBadRequest))
+		return "", "", nil, errors.New(http.StatusText(http.StatusBadRequest))
 	}
 	chain, project := params[2], params[1]
 
-	// Route URL: http://gateway-api/route/{chain_id}/{project_id}
-	client := &http.Client{Timeout: 1 * time.Second}
-	url := fmt.Sprintf("%s/%s/%s", routeChecker, chain, project)
-	resp, err := client.Get(url)
+	routeResp, err := routeChecker.Check(chain, project)
 	if err != nil {
 		zap.S().Errorw("grpc", "path", prefixPath, "statue", http.StatusInternalServerError)
-		return "", errors.New(http.StatusText(http.StatusInternalServerError))
+		return "", "", nil, errors.New(http.StatusText(http.StatusInternalServerError))
 	}
-	defer resp.Body.Close()
-
-	routeResp := RouteResponse{}
-	json.NewDecoder(resp.Body).Decode(&routeResp)
 	if !routeResp.Route {
 		zap.S().Errorw("grpc", "path", prefixPath, "statue", http.StatusForbidden)
-		return "", errors.New(http.StatusText(http.StatusForbidden))
+		return "", "", nil, errors.New(http.StatusText(http.StatusForbidden))
 	}
 
-	zap.S().Infow("grpc", "path", prefixPath, "target", routeResp.Target.GRPC)
-	return routeResp.Target.GRPC, nil
+	return chain, project, routeResp, nil
+}
+
+// sameTargets reports whether pool was built from the given balancer and
+// targets.
+func sameTargets(pool *UpstreamPool, balancer string, targets []UpstreamTarget) bool {
+	if pool.Strategy != balancer || len(pool.Upstreams) != len(targets) {
+		return false
+	}
+	for i, target := range targets {
+		u := pool.Upstreams[i]
+		if u.Target != target.URL || (target.Weight > 0 && u.Weight != target.Weight) {
+			return false
+		}
+	}
+	return true
 }
 
 // The HealthServer type is a gRPC server that implements the Check method for health checking.
-type HealthServer struct{}
+type HealthServer struct {
+	draining atomic.Bool
+}
+
+// Drain reports the server as not serving from now on.
+func (s *HealthServer) Drain() {
+	s.draining.Store(true)
+}
 
 func (s *HealthServer) Check(ctx context.Context, in *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if s.draining.Load() {
+		return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING}, nil
+	}
 	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
 }
 
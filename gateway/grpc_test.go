@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func grpcRoute(target string, fetched time.Time) *RouteResponse {
+	resp := &RouteResponse{Route: true, fetched: fetched}
+	resp.Target.GRPC = target
+	return resp
+}
+
+func TestGrpcPoolKeepsNewerTargets(t *testing.T) {
+	p := NewGrpcConnectionPool()
+	now := time.Now()
+	// Two projects of one chain, whose routes were cached at different times.
+	older := grpcRoute("127.0.0.1:9001", now.Add(-time.Minute))
+	newer := grpcRoute("127.0.0.1:9002", now)
+
+	if _, _, err := p.pick(context.Background(), "c", older); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for _, route := range []*RouteResponse{newer, older} {
+			upstream, _, err := p.pick(context.Background(), "c", route)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upstream.Target != "127.0.0.1:9002" {
+				t.Fatalf("round %d: picked %s, want the target of the newer lookup", i, upstream.Target)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	pool := p.upstreams["c"]
+	p.mu.Unlock()
+	upstream, _, err := p.pick(context.Background(), "c", older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.upstreams["c"] != pool || upstream.Target != "127.0.0.1:9002" {
+		t.Fatalf("the older lookup rebuilt the pool")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// HealthCheck holds the parameters of active health checking.
+type HealthCheck struct {
+	// Interval between two probes of the same upstream.
+	Interval time.Duration
+	// Timeout of a single probe.
+	Timeout time.Duration
+	// HealthyThreshold is the number of consecutive successful probes
+	// needed to re-admit an ejected upstream.
+	HealthyThreshold int
+	// UnhealthyThreshold is the number of consecutive failed probes after
+	// which an upstream is ejected.
+	UnhealthyThreshold int
+}
+
+// DefaultHealthCheck is used by every upstream pool.
+var DefaultHealthCheck = &HealthCheck{
+	Interval:           10 * time.Second,
+	Timeout:            3 * time.Second,
+	HealthyThreshold:   2,
+	UnhealthyThreshold: 3,
+}
+
+// HealthProbe checks that an upstream is able to serve requests.
+type HealthProbe func(ctx context.Context, u *Upstream) error
+
+var healthClient = &http.Client{}
+
+const lcdSyncingPath = "/cosmos/base/tendermint/v1beta1/syncing"
+
+// StartHealthChecks probes every upstream of the pool in the background
+// until Close is called.
+func (p *UpstreamPool) StartHealthChecks(probe HealthProbe) {
+	if p == nil || probe == nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	for _, u := range p.Upstreams {
+		go runHealthCheck(u, probe, DefaultHealthCheck, p.stop)
+	}
+}
+
+// Close stops the health checks of the pool.
+func (p *UpstreamPool) Close() {
+	if p != nil && p.stop != nil {
+		close(p.stop)
+	}
+}
+
+func runHealthCheck(u *Upstream, probe HealthProbe, hc *HealthCheck, stop <-chan struct{}) {
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+		err := probe(ctx, u)
+		cancel()
+
+		if err == nil {
+			successes, failures = successes+1, 0
+			if successes >= hc.HealthyThreshold && u.setHealthy(true) {
+				zap.S().Infow("health", "target", u.Target, "healthy", true)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if failures >= hc.UnhealthyThreshold && u.setHealthy(false) {
+				zap.S().Errorw("health", "target", u.Target, "healthy", false, "error", err.Error())
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// substrateHealth is the result of system_health.
+type substrateHealth struct {
+	Peers           int  `json:"peers"`
+	IsSyncing       bool `json:"isSyncing"`
+	ShouldHavePeers bool `json:"shouldHavePeers"`
+}
+
+func checkSubstrateHealth(result json.RawMessage) error {
+	var health substrateHealth
+	if err := json.Unmarshal(result, &health); err != nil {
+		return err
+	}
+	if health.IsSyncing {
+		return errors.New("node is syncing")
+	}
+	if health.ShouldHavePeers && health.Peers == 0 {
+		return errors.New("node has no peers")
+	}
+	return nil
+}
+
+// checkEvmSyncing accepts the false result eth_syncing returns once a node
+// is in sync; a syncing node returns an object with its progress instead.
+func checkEvmSyncing(result json.RawMessage) error {
+	var syncing bool
+	if err := json.Unmarshal(result, &syncing); err != nil || syncing {
+		return errors.New("node is syncing")
+	}
+	return nil
+}
+
+// SubstrateProbe calls system_health over HTTP or WebSocket.
+func SubstrateProbe(ctx context.Context, u *Upstream) error {
+	return jsonRpcProbe(ctx, u, "system_health", checkSubstrateHealth)
+}
+
+// EvmProbe calls eth_syncing over HTTP or WebSocket.
+func EvmProbe(ctx context.Context, u *Upstream) error {
+	return jsonRpcProbe(ctx, u, "eth_syncing", checkEvmSyncing)
+}
+
+// LcdProbe queries the Cosmos REST syncing endpoint.
+func LcdProbe(ctx context.Context, u *Upstream) error {
+	target := strings.TrimSuffix(u.URL.String(), "/") + lcdSyncingPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var syncing struct {
+		Syncing bool `json:"syncing"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&syncing); err != nil {
+		return err
+	}
+	if syncing.Syncing {
+		return errors.New("node is syncing")
+	}
+	return nil
+}
+
+// GrpcProbe returns a probe that calls the standard gRPC health service
+// over connections from dial.
+func GrpcProbe(dial func(ctx context.Context, target string) (*grpc.ClientConn, error)) HealthProbe {
+	return func(ctx context.Context, u *Upstream) error {
+		conn, err := dial(ctx, u.Target)
+		if err != nil {
+			return err
+		}
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		if status.Code(err) == codes.Unimplemented {
+			// Not every node registers the health service; answering at
+			// all shows the node is up.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+func jsonRpcProbe(ctx context.Context, u *Upstream, method string, check func(json.RawMessage) error) error {
+	body := []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"%s","params":[]}`, method))
+
+	var data []byte
+	switch u.URL.Scheme {
+	case "ws", "wss":
+		conn, _, err := DefaultDialer.DialContext(ctx, u.URL.String(), nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetReadDeadline(deadline)
+			conn.SetWriteDeadline(deadline)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, body); err != nil {
+			return err
+		}
+		if _, data, err = conn.ReadMessage(); err != nil {
+			return err
+		}
+	default:
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := healthClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(resp.Body); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  interface{}     `json:"error"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s: %v", method, resp.Error)
+	}
+	return check(resp.Result)
+}
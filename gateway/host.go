@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	chainLabelRe   = regexp.MustCompile(`^[a-z][-a-z0-9]*[a-z0-9]?$`)
+	projectLabelRe = regexp.MustCompile(`^([a-z0-9]{32}|[a-z0-9]{16})$`)
+)
+
+// HostRoutes map requests to gateway domains onto the v2 paths:
+//
+//	{project}.{chain}.{domain}[/{prefix}][/path]
+//	{chain}.{domain}[/{prefix}]/{project}[/path]
+//
+// The prefix of a protocol defaults to rpc.
+type HostRoutes struct {
+	Domains []string
+}
+
+// rewrite returns the v2 path of a request to host, false when host isn't
+// under one of the domains.
+func (h *HostRoutes) rewrite(host, path string) (string, bool) {
+	if h == nil || len(h.Domains) == 0 {
+		return "", false
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, domain := range h.Domains {
+		labels := strings.TrimSuffix(host, "."+domain)
+		if labels == host || labels == "" {
+			continue
+		}
+		prefix, rest := "rpc", strings.TrimPrefix(path, "/")
+		if segment, tail, _ := strings.Cut(rest, "/"); protocols[segment] != nil {
+			prefix, rest = segment, tail
+		}
+
+		var chain, project string
+		if p, c, ok := strings.Cut(labels, "."); ok {
+			project, chain = p, c
+		} else {
+			chain = labels
+			project, rest, _ = strings.Cut(rest, "/")
+		}
+		if !chainLabelRe.MatchString(chain) || !projectLabelRe.MatchString(project) {
+			return "", false
+		}
+
+		path = "/" + prefix + "/" + chain + "/" + project
+		if rest != "" {
+			path += "/" + rest
+		}
+		return path, true
+	}
+	return "", false
+}
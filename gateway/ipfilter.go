@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultDenylistRefreshInterval = 30 * time.Second
+
+// RouteIPs are the client IPs and CIDRs a project may be used from. Deny
+// always wins; when Allow isn't empty, clients must also match it.
+type RouteIPs struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow, deny []netip.Prefix
+}
+
+// parse decodes the lists once, after the route lookup.
+func (r *RouteIPs) parse() {
+	r.allow, r.deny = parsePrefixes(r.Allow), parsePrefixes(r.Deny)
+}
+
+// Allowed reports whether ip may use the project.
+func (r RouteIPs) Allowed(ip netip.Addr) bool {
+	if containsAddr(r.deny, ip) {
+		return false
+	}
+	// A malformed allowlist entry never lets clients in.
+	return len(r.Allow) == 0 || containsAddr(r.allow, ip)
+}
+
+// IPFilter finds the real IP of clients and applies the global denylist,
+// refreshed periodically from the gateway-api.
+type IPFilter struct {
+	url    string
+	client *http.Client
+
+	trusted  atomic.Value // []netip.Prefix
+	denylist atomic.Value // []netip.Prefix
+}
+
+// NewIPFilter trusts the X-Forwarded-For entries added by trusted proxies.
+// The denylist isn't polled when url is empty.
+func NewIPFilter(url, token string, trusted []netip.Prefix, interval time.Duration) *IPFilter {
+	f := &IPFilter{
+		url: url,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: apiTransport{http.DefaultTransport, token},
+		},
+	}
+	f.SetTrusted(trusted)
+	f.denylist.Store([]netip.Prefix(nil))
+	if url != "" {
+		go f.refreshLoop(interval)
+	}
+	return f
+}
+
+// SetTrusted replaces the trusted proxies.
+func (f *IPFilter) SetTrusted(trusted []netip.Prefix) {
+	f.trusted.Store(trusted)
+}
+
+// ClientIP returns the address of the client, walking X-Forwarded-For from
+// the nearest hop back for as long as hops are trusted proxies.
+func (f *IPFilter) ClientIP(remoteAddr string, forwardedFor []string) netip.Addr {
+	trusted := f.trusted.Load().([]netip.Prefix)
+	ip := parseAddr(remoteAddr)
+	if !ip.IsValid() || !containsAddr(trusted, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseAddr(strings.TrimSpace(hops[i]))
+		if !hop.IsValid() {
+			break
+		}
+		ip = hop
+		if !containsAddr(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Denied reports whether ip is on the global denylist.
+func (f *IPFilter) Denied(ip netip.Addr) bool {
+	return containsAddr(f.denylist.Load().([]netip.Prefix), ip)
+}
+
+func (f *IPFilter) refreshLoop(interval time.Duration) {
+	for {
+		if err := f.refresh(); err != nil {
+			zap.S().Errorw(fmt.Sprintf("ipfilter: couldn't refresh denylist | %s", err))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// refresh replaces the denylist; the previous one is kept on errors.
+func (f *IPFilter) refresh() error {
+	// Denylist URL: http://gateway-api/denylist
+	resp, err := f.client.Get(f.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Code int `json:"code"`
+		Data []struct {
+			CIDR string `json:"cidr"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Code != http.StatusOK {
+		return fmt.Errorf("unexpected code %d", result.Code)
+	}
+	cidrs := make([]string, 0, len(result.Data))
+	for _, entry := range result.Data {
+		cidrs = append(cidrs, entry.CIDR)
+	}
+	f.denylist.Store(parsePrefixes(cidrs))
+	return nil
+}
+
+// parsePrefixes parses CIDRs and single IPs, skipping malformed entries.
+func parsePrefixes(values []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			zap.S().Errorw(fmt.Sprintf("ipfilter: invalid cidr %q", value))
+		}
+	}
+	return prefixes
+}
+
+// parseAddr parses an IP with or without port.
+func parseAddr(value string) netip.Addr {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	f := NewIPFilter("", "", parsePrefixes([]string{"10.0.0.0/8", "130.211.0.0/22"}), time.Minute)
+
+	for _, test := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"untrusted remote", "198.51.100.7:1234", []string{"203.0.113.1"}, "198.51.100.7"},
+		{"trusted proxy", "130.211.0.5:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"trusted proxies", "10.0.0.2:1234", []string{"203.0.113.1, 130.211.0.5"}, "203.0.113.1"},
+		{"multiple headers", "10.0.0.2:1234", []string{"203.0.113.1", "130.211.0.5"}, "203.0.113.1"},
+		// Entries before the first untrusted hop are the client's to forge.
+		{"forged entries", "10.0.0.2:1234", []string{"192.0.2.1, 203.0.113.1, 130.211.0.5"}, "203.0.113.1"},
+		{"only proxies", "10.0.0.2:1234", []string{"130.211.0.5"}, "130.211.0.5"},
+		{"malformed hop", "10.0.0.2:1234", []string{"203.0.113.1, garbage, 130.211.0.5"}, "130.211.0.5"},
+		{"no header", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"ipv4-mapped", "[::ffff:198.51.100.7]:1234", nil, "198.51.100.7"},
+		{"ipv6", "[2001:db8::1]:1234", nil, "2001:db8::1"},
+	} {
+		if got := f.ClientIP(test.remoteAddr, test.forwardedFor); got.String() != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	f.SetTrusted(nil)
+	if got := f.ClientIP("10.0.0.2:1234", []string{"203.0.113.1"}); got.String() != "10.0.0.2" {
+		t.Errorf("no trusted proxies: got %s, want the remote address", got)
+	}
+}
+
+func TestRouteIPs(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		ips   RouteIPs
+		ip    string
+		allow bool
+	}{
+		{"no lists", RouteIPs{}, "198.51.100.7", true},
+		{"allowed cidr", RouteIPs{Allow: []string{"198.51.100.0/24"}}, "198.51.100.7", true},
+		{"allowed ip", RouteIPs{Allow: []string{"198.51.100.7"}}, "198.51.100.7", true},
+		{"not allowed", RouteIPs{Allow: []string{"198.51.100.0/24"}}, "203.0.113.1", false},
+		{"denied cidr", RouteIPs{Deny: []string{"198.51.100.0/24"}}, "198.51.100.7", false},
+		{"not denied", RouteIPs{Deny: []string{"198.51.100.0/24"}}, "203.0.113.1", true},
+		{"deny wins", RouteIPs{Allow: []string{"198.51.100.0/24"}, Deny: []string{"198.51.100.7"}}, "198.51.100.7", false},
+		{"unmasked cidr", RouteIPs{Allow: []string{"198.51.100.7/24"}}, "198.51.100.9", true},
+		{"ipv6", RouteIPs{Allow: []string{"2001:db8::/32"}}, "2001:db8::1", true},
+		{"malformed allowlist", RouteIPs{Allow: []string{"not-an-ip"}}, "198.51.100.7", false},
+		{"malformed denylist", RouteIPs{Deny: []string{"not-an-ip"}}, "198.51.100.7", true},
+		{"invalid client ip", RouteIPs{Deny: []string{"198.51.100.0/24"}}, "", true},
+	} {
+		test.ips.parse()
+		if got := test.ips.Allowed(parseAddr(test.ip)); got != test.allow {
+			t.Errorf("%s: got allowed %v, want %v", test.name, got, test.allow)
+		}
+	}
+}
+
+func TestIPFilterDenylist(t *testing.T) {
+	failing := false
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer t0ken" {
+			t.Errorf("got Authorization %q", req.Header.Get("Authorization"))
+		}
+		if failing {
+			rw.Write([]byte(`{"code":500}`))
+			return
+		}
+		rw.Write([]byte(`{"code":200,"data":[{"cidr":"198.51.100.0/24"},{"cidr":"203.0.113.1"}]}`))
+	}))
+	defer api.Close()
+
+	f := &IPFilter{url: api.URL, client: &http.Client{Transport: apiTransport{http.DefaultTransport, "t0ken"}}}
+	f.denylist.Store([]netip.Prefix(nil))
+	if f.Denied(parseAddr("198.51.100.7")) {
+		t.Fatal("denied before the denylist was fetched")
+	}
+	if err := f.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for ip, denied := range map[string]bool{
+		"198.51.100.7": true,
+		"203.0.113.1":  true,
+		"203.0.113.2":  false,
+	} {
+		if got := f.Denied(parseAddr(ip)); got != denied {
+			t.Errorf("%s: got denied %v, want %v", ip, got, denied)
+		}
+	}
+
+	// The previous denylist is kept when the API fails.
+	failing = true
+	if err := f.refresh(); err == nil {
+		t.Fatal("got no error")
+	}
+	if !f.Denied(parseAddr("198.51.100.7")) {
+		t.Fatal("denylist dropped on error")
+	}
+}
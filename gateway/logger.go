@@ -7,13 +7,16 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// logLevel can be changed at runtime through the admin API.
+var logLevel = zap.NewAtomicLevel()
+
 func InitLogger() {
 	consoleConfig := zap.NewProductionEncoderConfig()
 	consoleConfig.CallerKey = zapcore.OmitKey
 	consoleEncoder := zapcore.NewJSONEncoder(consoleConfig)
 	consoleSyncer := zapcore.Lock(os.Stdout)
 
-	core := zapcore.NewCore(consoleEncoder, consoleSyncer, zap.NewAtomicLevel())
+	core := zapcore.NewCore(consoleEncoder, consoleSyncer, logLevel)
 	logger := zap.New(core)
 	defer logger.Sync()
 
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// maxLabelValues bounds the distinct chains of the metrics, later ones are
+// reported as "other". Project ids are never used as labels.
+const maxLabelValues = 500
+
+// knownMethods are the methods used as labels whatever the route: standard
+// Substrate and Ethereum JSON-RPC methods, and the HTTP methods of REST
+// requests. Other methods are only labelled when the route explicitly
+// allows them, as clients may send any string.
+var knownMethods = map[string]bool{}
+
+func init() {
+	for _, method := range []string{
+		"author_hasKey", "author_hasSessionKeys", "author_insertKey", "author_pendingExtrinsics",
+		"author_removeExtrinsic", "author_rotateKeys", "author_submitAndWatchExtrinsic", "author_submitExtrinsic",
+		"author_unwatchExtrinsic",
+		"babe_epochAuthorship", "beefy_getFinalizedHead", "beefy_subscribeJustifications",
+		"beefy_unsubscribeJustifications",
+		"chain_getBlock", "chain_getBlockHash", "chain_getFinalizedHead", "chain_getHeader",
+		"chain_subscribeAllHeads", "chain_subscribeFinalizedHeads", "chain_subscribeNewHeads",
+		"chain_unsubscribeAllHeads", "chain_unsubscribeFinalizedHeads", "chain_unsubscribeNewHeads",
+		"childstate_getKeys", "childstate_getKeysPaged", "childstate_getStorage", "childstate_getStorageEntries",
+		"childstate_getStorageHash", "childstate_getStorageSize",
+		"grandpa_proveFinality", "grandpa_roundState", "grandpa_subscribeJustifications",
+		"grandpa_unsubscribeJustifications",
+		"mmr_generateProof", "mmr_root", "mmr_verifyProof", "mmr_verifyProofStateless",
+		"offchain_localStorageGet", "offchain_localStorageSet",
+		"payment_queryFeeDetails", "payment_queryInfo",
+		"rpc_methods",
+		"state_call", "state_getChildReadProof", "state_getKeys", "state_getKeysPaged", "state_getMetadata",
+		"state_getPairs", "state_getReadProof", "state_getRuntimeVersion", "state_getStorage",
+		"state_getStorageHash", "state_getStorageSize", "state_queryStorage", "state_queryStorageAt",
+		"state_subscribeRuntimeVersion", "state_subscribeStorage", "state_traceBlock",
+		"state_unsubscribeRuntimeVersion", "state_unsubscribeStorage",
+		"sync_state_genSyncSpec",
+		"system_accountNextIndex", "system_addLogFilter", "system_addReservedPeer", "system_chain",
+		"system_chainType", "system_dryRun", "system_health", "system_localListenAddresses",
+		"system_localPeerId", "system_name", "system_nodeRoles", "system_peers", "system_properties",
+		"system_removeReservedPeer", "system_reservedPeers", "system_resetLogFilter", "system_syncState",
+		"system_version",
+
+		"eth_accounts", "eth_blockNumber", "eth_call", "eth_chainId", "eth_coinbase", "eth_estimateGas",
+		"eth_feeHistory", "eth_gasPrice", "eth_getBalance", "eth_getBlockByHash", "eth_getBlockByNumber",
+		"eth_getBlockTransactionCountByHash", "eth_getBlockTransactionCountByNumber", "eth_getCode",
+		"eth_getFilterChanges", "eth_getFilterLogs", "eth_getLogs", "eth_getProof", "eth_getStorageAt",
+		"eth_getTransactionByBlockHashAndIndex", "eth_getTransactionByBlockNumberAndIndex",
+		"eth_getTransactionByHash", "eth_getTransactionCount", "eth_getTransactionReceipt",
+		"eth_getUncleByBlockHashAndIndex", "eth_getUncleByBlockNumberAndIndex", "eth_getUncleCountByBlockHash",
+		"eth_getUncleCountByBlockNumber", "eth_hashrate", "eth_maxPriorityFeePerGas", "eth_mining",
+		"eth_newBlockFilter", "eth_newFilter", "eth_newPendingTransactionFilter", "eth_protocolVersion",
+		"eth_sendRawTransaction", "eth_sendTransaction", "eth_sign", "eth_signTransaction", "eth_subscribe",
+		"eth_syncing", "eth_uninstallFilter", "eth_unsubscribe",
+		"net_listening", "net_peerCount", "net_version", "web3_clientVersion", "web3_sha3",
+
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions,
+	} {
+		knownMethods[method] = true
+	}
+}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_requests_total",
+		Help: "Requests and calls proxied to upstreams.",
+	}, []string{"chain", "protocol", "method", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_request_duration_seconds",
+		Help:    "Latency of requests and calls proxied to upstreams.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"chain", "protocol", "method", "status"})
+	unroutedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_unrouted_requests_total",
+		Help: "Requests answered by the gateway itself: rejected, denied by method policies or CORS preflights.",
+	}, []string{"service", "status"})
+	routeCacheTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_route_cache_lookups_total",
+		Help: "Route checks by result: hit, shared with an in-flight lookup, or miss.",
+	}, []string{"result"})
+	routeLookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_route_lookup_duration_seconds",
+		Help:    "Latency of the route lookups sent to the gateway-api.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+	websocketSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_websocket_subscriptions",
+		Help: "Subscriptions opened over WebSocket connections and not yet closed.",
+	})
+
+	chainLabels = newLabelValues(maxLabelValues)
+	// grpcMethodLabels are the gRPC methods upstreams answered successfully,
+	// the only ones used as labels.
+	grpcMethodLabels = newLabelValues(maxLabelValues)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, unroutedTotal, routeCacheTotal, routeLookupDuration,
+		websocketSubscriptions,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_websocket_connections",
+			Help: "Open WebSocket connections.",
+		}, func() float64 { return float64(DefaultSessions.Len()) }))
+}
+
+// labelValues caps the distinct values of a label.
+type labelValues struct {
+	mu     sync.Mutex
+	max    int
+	values map[string]struct{}
+}
+
+func newLabelValues(max int) *labelValues {
+	return &labelValues{max: max, values: make(map[string]struct{})}
+}
+
+// get returns value, or "other" once max other values have been seen.
+func (l *labelValues) get(value string) string {
+	if len(value) > 128 {
+		return "other"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.values[value]; !ok {
+		if len(l.values) >= l.max {
+			return "other"
+		}
+		l.values[value] = struct{}{}
+	}
+	return value
+}
+
+// has reports whether value is already used as a label.
+func (l *labelValues) has(value string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.values[value]
+	return ok
+}
+
+// observeRequest records a request or call proxied to the upstreams of a
+// chain. protocol is the route target serving it (rpc, ws, rest, grpc, ...),
+// method must already be a bounded label.
+func observeRequest(chain, protocol, method, status string, duration time.Duration) {
+	chain = chainLabels.get(chain)
+	requestsTotal.WithLabelValues(chain, protocol, method, status).Inc()
+	requestDuration.WithLabelValues(chain, protocol, method, status).Observe(duration.Seconds())
+}
+
+// observeRouted records a request of the Router, whose chain and protocol
+// are taken from the route of its context.
+func observeRouted(ctx context.Context, websocket bool, method, status string, duration time.Duration) {
+	info, ok := ctx.Value(routeInfoKey{}).(*routeInfo)
+	if !ok {
+		return
+	}
+	observeRequest(info.chain, protocols[info.protocol].target(websocket), methodLabel(info, method), status, duration)
+}
+
+// methodLabel returns method if it is known or allowed by name by the
+// method policy of the route, "other" otherwise.
+func methodLabel(info *routeInfo, method string) string {
+	if method == "" || knownMethods[method] {
+		return method
+	}
+	for _, allowed := range info.response.Methods[info.protocol].Allow {
+		if allowed == method {
+			return method
+		}
+	}
+	return "other"
+}
+
+// grpcMethodLabel returns the label of a gRPC method: the method once an
+// upstream has answered it successfully, "other" until then, as clients may
+// call any method.
+func grpcMethodLabel(method string, code codes.Code) string {
+	if code == codes.OK {
+		return grpcMethodLabels.get(method)
+	}
+	if grpcMethodLabels.has(method) {
+		return method
+	}
+	return "other"
+}
+
+// observeJsonRpc records every call of a JSON-RPC request.
+func observeJsonRpc(ctx context.Context, request interface{}, status string, duration time.Duration) {
+	switch r := request.(type) {
+	case JsonRpcRequest:
+		observeRouted(ctx, false, r.Method, status, duration)
+	case []JsonRpcRequest:
+		for _, call := range r {
+			observeRouted(ctx, false, call.Method, status, duration)
+		}
+	default:
+		observeRouted(ctx, false, "", status, duration)
+	}
+}
+
+// statusRecorder records the status of the responses the Router answers
+// itself.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// count records the response, if any was written.
+func (r *statusRecorder) count(service string) {
+	if r.status != 0 {
+		unroutedTotal.WithLabelValues(service, strconv.Itoa(r.status)).Inc()
+	}
+}
+
+// upstreamCollector reports the state of the upstreams of loaded proxies.
+// Upstreams are told apart by their index in the pool, as several may share
+// a host.
+type upstreamCollector struct {
+	upstreams func() []AdminUpstream
+}
+
+var (
+	upstreamHealthyDesc = prometheus.NewDesc("gateway_upstream_healthy",
+		"Whether the upstream passes its health checks.", []string{"chain", "protocol", "upstream", "host"}, nil)
+	upstreamBreakerDesc = prometheus.NewDesc("gateway_upstream_breaker_open",
+		"Whether the circuit breaker of the upstream is open or half open.", []string{"chain", "protocol", "upstream", "host"}, nil)
+	upstreamOutstandingDesc = prometheus.NewDesc("gateway_upstream_outstanding_requests",
+		"Requests in flight to the upstream.", []string{"chain", "protocol", "upstream", "host"}, nil)
+)
+
+func (c upstreamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamHealthyDesc
+	ch <- upstreamBreakerDesc
+	ch <- upstreamOutstandingDesc
+}
+
+func (c upstreamCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, u := range c.upstreams() {
+		labels := []string{u.Chain, u.Protocol, strconv.Itoa(u.Index), upstreamHost(u.Target)}
+		ch <- prometheus.MustNewConstMetric(upstreamHealthyDesc, prometheus.GaugeValue, boolValue(u.Healthy), labels...)
+		ch <- prometheus.MustNewConstMetric(upstreamBreakerDesc, prometheus.GaugeValue, boolValue(u.Breaker != BreakerClosed), labels...)
+		ch <- prometheus.MustNewConstMetric(upstreamOutstandingDesc, prometheus.GaugeValue, float64(u.Outstanding), labels...)
+	}
+}
+
+// upstreamHost returns the host of an upstream, as the paths of node
+// providers' URLs often carry API keys.
+func upstreamHost(target string) string {
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return target
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// jsonRpcMethod returns the method of a parsed WebSocket message, empty if
+// it has none.
+func jsonRpcMethod(method interface{}) string {
+	if method == nil {
+		return ""
+	}
+	return fmt.Sprint(method)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestGrpcMethodLabel(t *testing.T) {
+	const method = "/cosmos.bank.v1beta1.Query/Balance"
+	for _, code := range []codes.Code{codes.Unimplemented, codes.Canceled, codes.DeadlineExceeded, codes.Unavailable} {
+		if label := grpcMethodLabel(method, code); label != "other" {
+			t.Fatalf("unconfirmed method with %s: got %q, want other", code, label)
+		}
+	}
+	if label := grpcMethodLabel(method, codes.OK); label != method {
+		t.Fatalf("answered method: got %q, want %q", label, method)
+	}
+	// Once confirmed, failed calls of the method are labelled too.
+	if label := grpcMethodLabel(method, codes.DeadlineExceeded); label != method {
+		t.Fatalf("confirmed method: got %q, want %q", label, method)
+	}
+}
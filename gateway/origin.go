@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// requestOrigin returns the origin of a browser request, from the Origin
+// header or else the Referer.
+func requestOrigin(origin, referer string) string {
+	if origin != "" && origin != "null" {
+		return origin
+	}
+	if u, err := url.Parse(referer); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return ""
+}
+
+// originAllowed reports whether origin matches one of the patterns. Patterns
+// are origins (https://app.example.com) or hosts (app.example.com) matching
+// any scheme, and *.example.com matches any subdomain of example.com. The
+// port is part of the host: localhost:3000 only matches that port, and
+// app.example.com only origins on the scheme's default port.
+func originAllowed(patterns []string, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+			if scheme != u.Scheme {
+				continue
+			}
+			pattern = rest
+		}
+		if matchHost(strings.TrimSuffix(pattern, "/"), host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// JSON-RPC 2.0 method not found, also used for methods that aren't
+	// allowed.
+	jsonRpcMethodNotFound = -32601
+	jsonRpcParseError     = -32700
+)
+
+// errParse answers requests the method policy can't check.
+var errParse = &JsonRpcError{Code: jsonRpcParseError, Message: "Parse error"}
+
+// MethodPolicy restricts the JSON-RPC methods of a chain. A method matching
+// Deny is always rejected; when Allow isn't empty, a method must also match
+// it. Patterns may end with * to match any suffix.
+type MethodPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Allowed reports whether the policy lets method through.
+func (p MethodPolicy) Allowed(method string) bool {
+	if matchAnyMethod(p.Deny, method) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchAnyMethod(p.Allow, method)
+}
+
+// Empty reports whether the policy allows every method.
+func (p MethodPolicy) Empty() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// methodFilter carries what the method policy removed from an HTTP request
+// to the response.
+type methodFilter struct {
+	allowed func(string) bool
+	ids     []string
+	denied  []*JsonRpcErrorResponse
+}
+
+type methodFilterKey struct{}
+
+func methodNotAllowedError(method string) *JsonRpcError {
+	return &JsonRpcError{
+		Code:    jsonRpcMethodNotFound,
+		Message: "Method not found",
+		Data:    fmt.Sprintf("%s is not allowed", method),
+	}
+}
+
+// filterRequest removes the calls to methods that aren't allowed from a
+// single or batch JSON-RPC request. It returns the request to forward, nil
+// when nothing is left, the error responses of the removed calls and the ids
+// of rpc_methods calls whose result must be filtered. Removed notifications
+// get no response. Requests that can't be parsed strictly are an error, as
+// nodes may read them differently.
+func filterRequest(body []byte, allowed func(string) bool) ([]byte, []*JsonRpcErrorResponse, []string, error) {
+	if !isBatch(body) {
+		request, notification, err := parseCall(body)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !allowed(request.Method) {
+			if notification {
+				return nil, nil, nil, nil
+			}
+			return nil, []*JsonRpcErrorResponse{newJsonRpcErrorResponse(request.Id, methodNotAllowedError(request.Method))}, nil, nil
+		}
+		if request.Method == "rpc_methods" && !notification {
+			return body, nil, []string{rawId(request.Id)}, nil
+		}
+		return body, nil, nil, nil
+	}
+
+	batch, err := parseBatch(body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var forward []json.RawMessage
+	var denied []*JsonRpcErrorResponse
+	var ids []string
+	for _, raw := range batch {
+		request, notification, err := parseCall(raw)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !allowed(request.Method) {
+			if !notification {
+				denied = append(denied, newJsonRpcErrorResponse(request.Id, methodNotAllowedError(request.Method)))
+			}
+			continue
+		}
+		if request.Method == "rpc_methods" && !notification {
+			ids = append(ids, rawId(request.Id))
+		}
+		forward = append(forward, raw)
+	}
+	if len(forward) == len(batch) {
+		return body, nil, ids, nil
+	}
+	if len(forward) == 0 {
+		return nil, denied, nil, nil
+	}
+	data, err := json.Marshal(forward)
+	return data, denied, ids, err
+}
+
+// parseCall decodes a single JSON-RPC call and tells whether it is a
+// notification, without id. Input that decoders may read differently is
+// rejected: trailing data, duplicate keys and keys that only differ from
+// "method" or "id" by case.
+func parseCall(raw []byte) (JsonRpcRequest, bool, error) {
+	var request JsonRpcRequest
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return request, false, errors.New("json: not a JSON-RPC call")
+	}
+	keys := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return request, false, err
+		}
+		key := tok.(string)
+		if keys[key] {
+			return request, false, fmt.Errorf("json: duplicate key %q", key)
+		}
+		for _, name := range []string{"method", "id"} {
+			if key != name && strings.EqualFold(key, name) {
+				return request, false, fmt.Errorf("json: ambiguous key %q", key)
+			}
+		}
+		keys[key] = true
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return request, false, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return request, false, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return request, false, errors.New("json: trailing data after JSON-RPC call")
+	}
+	err := json.Unmarshal(raw, &request)
+	return request, !keys["id"], err
+}
+
+// parseBatch splits a JSON-RPC batch into its calls, rejecting empty batches
+// and trailing data.
+func parseBatch(body []byte) ([]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errors.New("json: not a JSON-RPC batch")
+	}
+	var batch []json.RawMessage
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		batch = append(batch, raw)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("json: trailing data after JSON-RPC batch")
+	}
+	if len(batch) == 0 {
+		return nil, errors.New("json: empty JSON-RPC batch")
+	}
+	return batch, nil
+}
+
+// filterResponse removes the methods that aren't allowed from the results of
+// rpc_methods calls and appends the error responses of removed calls to a
+// batch response.
+func filterResponse(body []byte, allowed func(string) bool, ids []string, denied []*JsonRpcErrorResponse) ([]byte, error) {
+	var batch []json.RawMessage
+	isBatch := json.Unmarshal(body, &batch) == nil
+	if !isBatch {
+		batch = []json.RawMessage{body}
+	}
+
+	if len(ids) > 0 {
+		for i, raw := range batch {
+			filtered, err := filterRpcMethods(raw, allowed, ids)
+			if err != nil {
+				return nil, err
+			}
+			batch[i] = filtered
+		}
+	}
+	for _, d := range denied {
+		data, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, data)
+	}
+
+	if !isBatch && len(batch) == 1 {
+		return batch[0], nil
+	}
+	return json.Marshal(batch)
+}
+
+// filterRpcMethods filters the result of a single rpc_methods response.
+func filterRpcMethods(raw json.RawMessage, allowed func(string) bool, ids []string) (json.RawMessage, error) {
+	var resp struct {
+		Id     *json.RawMessage `json:"id"`
+		Result *struct {
+			Version int      `json:"version"`
+			Methods []string `json:"methods"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil || resp.Result == nil || !containsId(ids, rawId(resp.Id)) {
+		return raw, nil
+	}
+
+	methods := make([]string, 0, len(resp.Result.Methods))
+	for _, method := range resp.Result.Methods {
+		if allowed(method) {
+			methods = append(methods, method)
+		}
+	}
+	resp.Result.Methods = methods
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	m["result"] = resp.Result
+	return json.Marshal(m)
+}
+
+func rawId(id *json.RawMessage) string {
+	if id == nil {
+		return "null"
+	}
+	return string(*id)
+}
+
+func containsId(ids []string, id string) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMethods removes the calls to methods that aren't allowed from a
+// JSON-RPC request over HTTP. It returns false when the request has been
+// answered, because none of its calls are allowed or it can't be parsed.
+func filterMethods(rw http.ResponseWriter, req *http.Request, allowed func(string) bool) (*http.Request, bool) {
+	if allowed == nil || req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, false
+	}
+
+	forward, denied, ids, err := filterRequest(body, allowed)
+	if err != nil {
+		zap.S().Errorw("policy", "path", req.URL.Path, "error", err)
+		rw.Header().Set("Content-Type", "application/json")
+		data, _ := json.Marshal(newJsonRpcErrorResponse(nil, errParse))
+		rw.Write(data)
+		return nil, false
+	}
+	if forward == nil {
+		// Notifications are answered with an empty response.
+		rw.Header().Set("Content-Type", "application/json")
+		if len(denied) > 0 {
+			rw.Write(marshalDenied(body, denied))
+		}
+		return nil, false
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(forward))
+	req.ContentLength = int64(len(forward))
+	if len(denied) > 0 || len(ids) > 0 {
+		f := &methodFilter{allowed: allowed, ids: ids, denied: denied}
+		req = req.WithContext(context.WithValue(req.Context(), methodFilterKey{}, f))
+		// The response is rewritten, let the transport decompress it.
+		req.Header.Del("Accept-Encoding")
+	}
+	return req, true
+}
+
+// filterProxyResponse completes the response to a request filtered by
+// filterMethods. CORS headers are the gateway's own. Filtered requests are
+// sent without the client's Accept-Encoding, responses gzipped anyway are
+// decoded. Whatever the status, removed calls are answered: when the body
+// isn't a JSON-RPC response, it is replaced by their error responses.
+func filterProxyResponse(resp *http.Response) error {
+	stripCORSHeaders(resp)
+	f, ok := resp.Request.Context().Value(methodFilterKey{}).(*methodFilter)
+	if !ok || (resp.StatusCode != http.StatusOK && len(f.denied) == 0) {
+		return nil
+	}
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return err
+	}
+
+	if filtered, err := filterResponse(body, f.allowed, f.ids, f.denied); err == nil {
+		body = filtered
+	} else if len(f.denied) > 0 {
+		// Only batches are forwarded with denied calls.
+		body, _ = json.Marshal(f.denied)
+		resp.Header.Set("Content-Type", "application/json")
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// readResponseBody reads and closes the body of a response, decoding it if
+// it was gzipped.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	switch resp.Header.Get("Content-Encoding") {
+	case "":
+		return io.ReadAll(resp.Body)
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		resp.Header.Del("Content-Encoding")
+		return io.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("policy: unsupported Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// marshalDenied encodes the error responses of removed calls the way the
+// request was sent, as a single response or a batch.
+func marshalDenied(request []byte, denied []*JsonRpcErrorResponse) []byte {
+	var data []byte
+	if len(denied) == 1 && !isBatch(request) {
+		data, _ = json.Marshal(denied[0])
+	} else {
+		data, _ = json.Marshal(denied)
+	}
+	return data
+}
+
+func isBatch(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) > 0 && body[0] == '['
+}
+
+// responseIds returns the ids of a single or batch JSON-RPC response.
+func responseIds(body []byte) []string {
+	var batch []JsonRpcResponse
+	if err := json.Unmarshal(body, &batch); err != nil {
+		var response JsonRpcResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil
+		}
+		batch = []JsonRpcResponse{response}
+	}
+	ids := make([]string, 0, len(batch))
+	for _, x := range batch {
+		ids = append(ids, rawId(x.Id))
+	}
+	return ids
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCall(t *testing.T) {
+	for _, test := range []struct {
+		raw          string
+		method       string
+		notification bool
+		ok           bool
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"chain_getBlock"}`, "chain_getBlock", false, true},
+		{` {"jsonrpc":"2.0","id":null,"method":"chain_getBlock"} `, "chain_getBlock", false, true},
+		{`{"jsonrpc":"2.0","method":"chain_getBlock"}`, "chain_getBlock", true, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"chain_getBlock","params":{"method":"x"}}`, "chain_getBlock", false, true},
+		// Decoders disagree on which of these keys wins.
+		{`{"id":1,"method":"chain_getBlock","method":"author_rotateKeys"}`, "", false, false},
+		{`{"id":1,"method":"chain_getBlock","Method":"author_rotateKeys"}`, "", false, false},
+		{`{"id":1,"METHOD":"author_rotateKeys"}`, "", false, false},
+		{`{"ID":1,"method":"author_rotateKeys"}`, "", false, false},
+		{`{"id":1,"id":2,"method":"chain_getBlock"}`, "", false, false},
+		// Streaming decoders run the first call and ignore the rest.
+		{`{"id":1,"method":"chain_getBlock"}{"id":2,"method":"author_rotateKeys"}`, "", false, false},
+		{`{"id":1,"method":"chain_getBlock"} x`, "", false, false},
+		{`{"id":1,"method":"chain_getBlock"`, "", false, false},
+		{`{"id":1,"method":1}`, "", false, false},
+		{`[{"id":1,"method":"chain_getBlock"}]`, "", false, false},
+		{`"chain_getBlock"`, "", false, false},
+		{``, "", false, false},
+	} {
+		request, notification, err := parseCall([]byte(test.raw))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.raw, err, test.ok)
+			continue
+		}
+		if test.ok && (request.Method != test.method || notification != test.notification) {
+			t.Errorf("%s: got method %q notification %v, want %q %v", test.raw, request.Method, notification, test.method, test.notification)
+		}
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	for _, test := range []struct {
+		body  string
+		calls int
+		ok    bool
+	}{
+		{`[{"id":1,"method":"a"},{"id":2,"method":"b"}]`, 2, true},
+		{` [ {"id":1,"method":"a"} ] `, 1, true},
+		{`[]`, 0, false},
+		{`[{"id":1,"method":"a"}][{"id":2,"method":"b"}]`, 0, false},
+		{`[{"id":1,"method":"a"}] x`, 0, false},
+		{`[{"id":1,"method":"a"},]`, 0, false},
+		{`[{"id":1,"method":"a"}`, 0, false},
+		{`{"id":1,"method":"a"}`, 0, false},
+	} {
+		batch, err := parseBatch([]byte(test.body))
+		if (err == nil) != test.ok || len(batch) != test.calls {
+			t.Errorf("%s: got %d calls, error %v, want %d calls, ok %v", test.body, len(batch), err, test.calls, test.ok)
+		}
+	}
+}
+
+func denyAuthor(method string) bool {
+	return !strings.HasPrefix(method, "author_")
+}
+
+func TestFilterRequest(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		body    string
+		forward string // empty when nothing is forwarded
+		denied  string // the error responses, as marshalDenied encodes them
+		ids     []string
+		ok      bool
+	}{
+		{
+			name:    "allowed call",
+			body:    `{"jsonrpc":"2.0","id":1,"method":"chain_getBlock"}`,
+			forward: `{"jsonrpc":"2.0","id":1,"method":"chain_getBlock"}`,
+			ok:      true,
+		},
+		{
+			name:   "denied call",
+			body:   `{"jsonrpc":"2.0","id":1,"method":"author_rotateKeys"}`,
+			denied: `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"Method not found","data":"author_rotateKeys is not allowed"}}`,
+			ok:     true,
+		},
+		{
+			name: "denied notification",
+			body: `{"jsonrpc":"2.0","method":"author_rotateKeys"}`,
+			ok:   true,
+		},
+		{
+			name:    "rpc_methods",
+			body:    `{"jsonrpc":"2.0","id":"a","method":"rpc_methods"}`,
+			forward: `{"jsonrpc":"2.0","id":"a","method":"rpc_methods"}`,
+			ids:     []string{`"a"`},
+			ok:      true,
+		},
+		{
+			name:    "mixed batch",
+			body:    `[{"jsonrpc":"2.0","id":1,"method":"chain_getBlock"},{"jsonrpc":"2.0","id":2,"method":"author_rotateKeys"},{"jsonrpc":"2.0","method":"author_insertKey"},{"jsonrpc":"2.0","id":3,"method":"rpc_methods"}]`,
+			forward: `[{"jsonrpc":"2.0","id":1,"method":"chain_getBlock"},{"jsonrpc":"2.0","id":3,"method":"rpc_methods"}]`,
+			denied:  `[{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"Method not found","data":"author_rotateKeys is not allowed"}}]`,
+			ids:     []string{"3"},
+			ok:      true,
+		},
+		{
+			name:   "denied batch",
+			body:   `[{"jsonrpc":"2.0","id":1,"method":"author_rotateKeys"}]`,
+			denied: `[{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"Method not found","data":"author_rotateKeys is not allowed"}}]`,
+			ok:     true,
+		},
+		{
+			name: "denied notifications batch",
+			body: `[{"jsonrpc":"2.0","method":"author_rotateKeys"},{"jsonrpc":"2.0","method":"author_insertKey"}]`,
+			ok:   true,
+		},
+		{name: "case variant method", body: `{"id":1,"method":"chain_getBlock","Method":"author_rotateKeys"}`},
+		{name: "duplicate method", body: `{"id":1,"method":"chain_getBlock","method":"author_rotateKeys"}`},
+		{name: "trailing call", body: `{"id":1,"method":"chain_getBlock"}{"id":2,"method":"author_rotateKeys"}`},
+		{name: "malformed batch element", body: `[{"id":1,"method":"chain_getBlock"},{"id":2,"Method":"author_rotateKeys"}]`},
+		{name: "batch element not an object", body: `[{"id":1,"method":"chain_getBlock"},"author_rotateKeys"]`},
+		{name: "trailing batch", body: `[{"id":1,"method":"chain_getBlock"}][{"id":2,"method":"author_rotateKeys"}]`},
+	} {
+		forward, denied, ids, err := filterRequest([]byte(test.body), denyAuthor)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if string(forward) != test.forward {
+			t.Errorf("%s: forwarded %s, want %s", test.name, forward, test.forward)
+		}
+		if len(denied) > 0 || test.denied != "" {
+			if got := string(marshalDenied([]byte(test.body), denied)); got != test.denied {
+				t.Errorf("%s: denied %s, want %s", test.name, got, test.denied)
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+			t.Errorf("%s: got rpc_methods ids %v, want %v", test.name, ids, test.ids)
+		}
+	}
+}
+
+func TestFilterMethodsAnswersDeniedNotifications(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/rpc/c/p", strings.NewReader(`{"jsonrpc":"2.0","method":"author_rotateKeys"}`))
+	if _, ok := filterMethods(rw, req, denyAuthor); ok {
+		t.Fatalf("denied notification forwarded")
+	}
+	if rw.Code != http.StatusOK || rw.Body.Len() != 0 {
+		t.Fatalf("got %d %q, want an empty response", rw.Code, rw.Body.String())
+	}
+}
+
+func TestFilterProxyResponse(t *testing.T) {
+	body := `[{"jsonrpc":"2.0","id":1,"method":"chain_getBlock"},{"jsonrpc":"2.0","id":2,"method":"author_rotateKeys"}]`
+	denied := `{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"Method not found","data":"author_rotateKeys is not allowed"}}`
+	for _, test := range []struct {
+		name     string
+		status   int
+		upstream string
+		want     string
+	}{
+		{"ok", http.StatusOK, `[{"jsonrpc":"2.0","id":1,"result":"0x1"}]`, `[{"jsonrpc":"2.0","id":1,"result":"0x1"},` + denied + `]`},
+		{"json-rpc error", http.StatusInternalServerError, `[{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"Internal error"}}]`,
+			`[{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"Internal error"}},` + denied + `]`},
+		{"bad gateway", http.StatusBadGateway, `<html>Bad Gateway</html>`, `[` + denied + `]`},
+		{"empty", http.StatusServiceUnavailable, ``, `[` + denied + `]`},
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/rpc/c/p", strings.NewReader(body))
+		req, ok := filterMethods(rw, req, denyAuthor)
+		if !ok {
+			t.Fatalf("%s: request answered by the filter", test.name)
+		}
+		resp := &http.Response{
+			StatusCode: test.status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(test.upstream)),
+			Request:    req,
+		}
+		if err := filterProxyResponse(resp); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != test.want || resp.StatusCode != test.status {
+			t.Errorf("%s: got %d %s, want %d %s", test.name, resp.StatusCode, got, test.status, test.want)
+		}
+	}
+
+	// Responses to requests without denied calls are left alone.
+	req := httptest.NewRequest(http.MethodPost, "/rpc/c/p", nil)
+	req = req.WithContext(context.WithValue(req.Context(), methodFilterKey{}, &methodFilter{allowed: denyAuthor, ids: []string{"1"}}))
+	resp := &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("oops")), Request: req}
+	if err := filterProxyResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(resp.Body); string(got) != "oops" {
+		t.Errorf("got %q, want the upstream's body", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Protocol is an API family the Router serves under a v2 path prefix, such
+// as /rpc/{chain}/{project}. HTTPTarget and WSTarget name the route targets
+// (see RouteResponse.Targets) serving its HTTP and WebSocket requests; an
+// empty WSTarget means the protocol has no WebSocket API.
+type Protocol struct {
+	Name       string
+	Prefix     string
+	HTTPTarget string
+	WSTarget   string
+
+	// JsonRpc protocols are subject to method policies and have the rate
+	// limits and quotas applied to every WebSocket message.
+	JsonRpc bool
+
+	// NewHandler creates the handler of HTTP requests for an upstream pool.
+	NewHandler func(upstreams *UpstreamPool) http.Handler
+	// Probe checks the health of the protocol's upstreams.
+	Probe HealthProbe
+}
+
+var (
+	protocols = map[string]*Protocol{}
+	v2PathRe  *regexp.Regexp
+)
+
+// RegisterProtocol adds a protocol to the Router. Protocols must be
+// registered before serving, typically from init functions.
+func RegisterProtocol(p *Protocol) {
+	if _, ok := protocols[p.Prefix]; ok {
+		panic(fmt.Sprintf("protocol: prefix %s registered twice", p.Prefix))
+	}
+	protocols[p.Prefix] = p
+
+	prefixes := make([]string, 0, len(protocols))
+	for prefix := range protocols {
+		prefixes = append(prefixes, regexp.QuoteMeta(prefix))
+	}
+	v2PathRe = regexp.MustCompile(`^/(` + strings.Join(prefixes, "|") +
+		`)/(?P<chain>[a-z][-a-z0-9]*[a-z0-9]?)/(?P<project>[a-z0-9]{32}|[a-z0-9]{16})(?:\/|$)(?P<path>[^?#]*)$`)
+}
+
+func init() {
+	RegisterProtocol(&Protocol{
+		Name:       "substrate-rpc",
+		Prefix:     "rpc",
+		HTTPTarget: "rpc",
+		WSTarget:   "ws",
+		JsonRpc:    true,
+		NewHandler: func(upstreams *UpstreamPool) http.Handler { return NewJsonRpcProxy(upstreams) },
+		Probe:      SubstrateProbe,
+	})
+	RegisterProtocol(&Protocol{
+		Name:       "evm-rpc",
+		Prefix:     "eth",
+		HTTPTarget: "eth_rpc",
+		WSTarget:   "eth_ws",
+		JsonRpc:    true,
+		NewHandler: func(upstreams *UpstreamPool) http.Handler { return NewJsonRpcProxy(upstreams) },
+		Probe:      EvmProbe,
+	})
+	RegisterProtocol(&Protocol{
+		Name:       "cosmos-lcd",
+		Prefix:     "lcd",
+		HTTPTarget: "rest",
+		NewHandler: func(upstreams *UpstreamPool) http.Handler { return NewRestProxy(upstreams) },
+		Probe:      LcdProbe,
+	})
+}
+
+// target returns the route target serving a request of the protocol, empty
+// when the protocol has none for the request.
+func (p *Protocol) target(websocket bool) string {
+	if websocket {
+		return p.WSTarget
+	}
+	return p.HTTPTarget
+}
+
+func (p *Protocol) unsupported(websocket bool) string {
+	if websocket {
+		return fmt.Sprintf("Protocol %s over WebSocket is not supported for this chain", p.Name)
+	}
+	return fmt.Sprintf("Protocol %s is not supported for this chain", p.Name)
+}
+
+// protocolProxy holds the handlers of one protocol for a chain. Handlers are
+// nil when the chain has no upstream for them.
+type protocolProxy struct {
+	http      http.Handler
+	httpPool  *UpstreamPool
+	websocket *WebsocketProxy
+}
+
+// isWebsocket reports whether req asks for a WebSocket upgrade.
+func isWebsocket(req *http.Request) bool {
+	// TODO: connection := req.Header.Get("Connection")
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
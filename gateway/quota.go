@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const quotaFlushInterval = 10 * time.Second
+
+type (
+	// Quota of a project over one period, as reported by the route lookup.
+	// Used is the usage the API knew of at lookup time; Start is the first
+	// day of the period it belongs to. Zero limits mean unlimited.
+	Quota struct {
+		Soft  int64  `json:"soft"`
+		Hard  int64  `json:"hard"`
+		Used  int64  `json:"used"`
+		Start string `json:"start"`
+	}
+
+	RouteQuota struct {
+		Daily   Quota `json:"daily"`
+		Monthly Quota `json:"monthly"`
+	}
+
+	// QuotaResult describes a quota that has been reached.
+	QuotaResult struct {
+		Period string `json:"period"`
+		Limit  int64  `json:"limit"`
+		Used   int64  `json:"used"`
+		Reset  string `json:"reset"`
+
+		// exceeded is set when a hard quota rejects the request, otherwise
+		// a soft quota has been passed.
+		exceeded bool
+	}
+)
+
+type usageKey struct {
+	project string
+	day     string
+}
+
+// projectUsage counts the requests of a project since the route lookup
+// its quota was taken from.
+type projectUsage struct {
+	snapshot *RouteResponse
+	day      string
+	daily    int64
+	monthly  int64
+}
+
+// QuotaTracker counts requests per project, enforces daily and monthly
+// quotas and periodically reports the counts to the gateway-api. Usage from
+// other gateway replicas is only seen through the route lookups.
+type QuotaTracker struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	usage   map[string]*projectUsage
+	pending map[usageKey]int64 // counted but not yet reported
+}
+
+func NewQuotaTracker(url, token string) *QuotaTracker {
+	t := &QuotaTracker{
+		url: url,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: apiTransport{http.DefaultTransport, token},
+		},
+		usage:   make(map[string]*projectUsage),
+		pending: make(map[usageKey]int64),
+	}
+	go t.flushLoop()
+	return t
+}
+
+// Check counts a request of project unless a hard quota has been reached.
+// The result is nil when no quota is reached, a warning when a soft quota
+// is passed and exceeded when the request must be rejected.
+func (t *QuotaTracker) Check(project string, routeResp *RouteResponse) *QuotaResult {
+	now := time.Now().UTC()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")+"-01"
+	quota := routeResp.Quota
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.usage[project]
+	if !ok || u.snapshot != routeResp {
+		// Counts that haven't been reported yet aren't part of the
+		// usage returned by the lookup.
+		u = &projectUsage{snapshot: routeResp, day: day}
+		for key, count := range t.pending {
+			if key.project != project {
+				continue
+			}
+			if key.day == day {
+				u.daily += count
+			}
+			if strings.HasPrefix(key.day, month[:7]) {
+				u.monthly += count
+			}
+		}
+		t.usage[project] = u
+	}
+	if u.day != day {
+		if !strings.HasPrefix(u.day, month[:7]) {
+			u.monthly = 0
+		}
+		u.day, u.daily = day, 0
+	}
+
+	daily, monthly := u.daily, u.monthly
+	if quota.Daily.Start == day {
+		daily += quota.Daily.Used
+	}
+	if quota.Monthly.Start == month {
+		monthly += quota.Monthly.Used
+	}
+	nextDay := now.Truncate(24*time.Hour).AddDate(0, 0, 1)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	if quota.Daily.Hard > 0 && daily >= quota.Daily.Hard {
+		return &QuotaResult{Period: "daily", Limit: quota.Daily.Hard, Used: daily, Reset: nextDay.Format(time.RFC3339), exceeded: true}
+	}
+	if quota.Monthly.Hard > 0 && monthly >= quota.Monthly.Hard {
+		return &QuotaResult{Period: "monthly", Limit: quota.Monthly.Hard, Used: monthly, Reset: nextMonth.Format(time.RFC3339), exceeded: true}
+	}
+
+	u.daily++
+	u.monthly++
+	t.pending[usageKey{project, day}]++
+
+	if quota.Daily.Soft > 0 && daily+1 > quota.Daily.Soft {
+		return &QuotaResult{Period: "daily", Limit: quota.Daily.Soft, Used: daily + 1, Reset: nextDay.Format(time.RFC3339)}
+	}
+	if quota.Monthly.Soft > 0 && monthly+1 > quota.Monthly.Soft {
+		return &QuotaResult{Period: "monthly", Limit: quota.Monthly.Soft, Used: monthly + 1, Reset: nextMonth.Format(time.RFC3339)}
+	}
+	return nil
+}
+
+func (r *QuotaResult) String() string {
+	return fmt.Sprintf("%s quota %d/%d, resets at %s", r.Period, r.Used, r.Limit, r.Reset)
+}
+
+func (t *QuotaTracker) flushLoop() {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.Flush()
+	}
+}
+
+// Flush reports the pending counts to the gateway-api. Counts that couldn't
+// be reported are kept for the next attempt.
+func (t *QuotaTracker) Flush() {
+	defer t.prune()
+
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[usageKey]int64)
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	type usage struct {
+		Project string `json:"project"`
+		Day     string `json:"day"`
+		Count   int64  `json:"count"`
+	}
+	body := make([]usage, 0, len(pending))
+	for key, count := range pending {
+		body = append(body, usage{key.project, key.day, count})
+	}
+
+	if err := t.post(body); err != nil {
+		zap.S().Errorw(fmt.Sprintf("quota: couldn't report usage | %s", err))
+		t.mu.Lock()
+		for key, count := range pending {
+			t.pending[key] += count
+		}
+		t.mu.Unlock()
+	}
+}
+
+// prune drops the usage of projects whose day has passed and whose counts
+// have all been reported. Their next request starts from a newer lookup.
+func (t *QuotaTracker) prune() {
+	day := time.Now().UTC().Format("2006-01-02")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unreported := make(map[string]bool)
+	for key := range t.pending {
+		unreported[key.project] = true
+	}
+	for project, u := range t.usage {
+		if u.day != day && !unreported[project] {
+			delete(t.usage, project)
+		}
+	}
+}
+
+func (t *QuotaTracker) post(body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	// Usage URL: http://gateway-api/usage
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Code int `json:"code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Code != http.StatusOK {
+		return fmt.Errorf("unexpected code %d", result.Code)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	rateLimitSweepInterval = time.Minute
+	rateLimitIdleTimeout   = 10 * time.Minute
+)
+
+type (
+	// Limit is a token bucket refilled with Rate tokens per second and
+	// holding at most Burst tokens. A zero Rate means unlimited.
+	Limit struct {
+		Rate  float64 `json:"rate"`
+		Burst int     `json:"burst"`
+	}
+
+	// RouteLimits are the limits the route lookup reports for a project and
+	// the chain it uses.
+	RouteLimits struct {
+		Project Limit `json:"project"`
+		Chain   Limit `json:"chain"`
+	}
+
+	// RateLimitResult is the outcome of taking a token from a bucket.
+	RateLimitResult struct {
+		Allowed   bool
+		Limit     int
+		Remaining int
+		// Reset is the time until the next token is available.
+		Reset time.Duration
+	}
+)
+
+// burst returns the bucket capacity, at least one second worth of tokens.
+func (l Limit) burst() float64 {
+	return math.Max(float64(l.Burst), math.Max(l.Rate, 1))
+}
+
+// RateLimitBackend takes tokens from buckets, possibly shared between
+// gateway replicas.
+type RateLimitBackend interface {
+	// Allow takes a token from every bucket of keys, or from none of them
+	// when any is empty, so that denied requests don't use up the budget of
+	// the other buckets. Results are in the order of keys.
+	Allow(ctx context.Context, keys []string, limits []Limit) ([]RateLimitResult, error)
+}
+
+// RateLimiter enforces the per-project and per-chain limits of routes. When
+// the backend fails, the local in-memory buckets are used instead so that a
+// backend outage neither blocks nor unthrottles traffic.
+type RateLimiter struct {
+	backend  RateLimitBackend
+	fallback *MemoryRateLimitBackend
+}
+
+func NewRateLimiter(backend RateLimitBackend) *RateLimiter {
+	fallback, ok := backend.(*MemoryRateLimitBackend)
+	if !ok {
+		fallback = NewMemoryRateLimitBackend()
+	}
+	return &RateLimiter{backend: backend, fallback: fallback}
+}
+
+// Check takes a token from both the project's and the chain's bucket, only
+// when both have one. The result describes the most constrained of the two.
+func (l *RateLimiter) Check(ctx context.Context, chain, project string, limits RouteLimits) RateLimitResult {
+	var keys []string
+	var bucketLimits []Limit
+	if limits.Project.Rate > 0 {
+		keys, bucketLimits = append(keys, "project:"+project), append(bucketLimits, limits.Project)
+	}
+	if limits.Chain.Rate > 0 {
+		keys, bucketLimits = append(keys, "chain:"+chain), append(bucketLimits, limits.Chain)
+	}
+	if len(keys) == 0 {
+		return RateLimitResult{Allowed: true, Remaining: math.MaxInt32}
+	}
+
+	results, err := l.backend.Allow(ctx, keys, bucketLimits)
+	if err != nil {
+		zap.S().Errorw(fmt.Sprintf("ratelimit: backend error %v | %s", keys, err))
+		results, _ = l.fallback.Allow(ctx, keys, bucketLimits)
+	}
+	result := results[0]
+	for _, r := range results[1:] {
+		if (result.Allowed && !r.Allowed) || (result.Allowed == r.Allowed && r.Remaining < result.Remaining) {
+			result = r
+		}
+	}
+	return result
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryRateLimitBackend keeps token buckets in-process. Limits only hold
+// per gateway replica.
+type MemoryRateLimitBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewMemoryRateLimitBackend() *MemoryRateLimitBackend {
+	b := &MemoryRateLimitBackend{buckets: make(map[string]*tokenBucket)}
+	go b.sweep()
+	return b
+}
+
+// Allow takes a token from every bucket of keys, or from none of them when
+// any is empty.
+func (m *MemoryRateLimitBackend) Allow(ctx context.Context, keys []string, limits []Limit) ([]RateLimitResult, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buckets := make([]*tokenBucket, len(keys))
+	admitted := true
+	for i, key := range keys {
+		capacity := limits[i].burst()
+		b, ok := m.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: capacity, last: now}
+			m.buckets[key] = b
+		}
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*limits[i].Rate)
+		b.last = now
+		buckets[i] = b
+		admitted = admitted && b.tokens >= 1
+	}
+
+	results := make([]RateLimitResult, len(keys))
+	for i, b := range buckets {
+		result := RateLimitResult{Limit: int(math.Ceil(limits[i].Rate)), Allowed: b.tokens >= 1}
+		if admitted {
+			b.tokens--
+		}
+		result.Remaining = int(b.tokens)
+		if b.tokens < 1 {
+			result.Reset = time.Duration((1 - b.tokens) / limits[i].Rate * float64(time.Second))
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// sweep drops buckets that haven't been used for a while; they would be
+// full again anyway.
+func (m *MemoryRateLimitBackend) sweep() {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		m.mu.Lock()
+		for key, b := range m.buckets {
+			if now.Sub(b.last) > rateLimitIdleTimeout {
+				delete(m.buckets, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// setRateLimitHeaders reports a limited result in the X-RateLimit-* headers.
+func setRateLimitHeaders(h http.Header, result RateLimitResult) {
+	if result.Limit == 0 {
+		return
+	}
+	reset := int(math.Ceil(result.Reset.Seconds()))
+	h.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(reset))
+	if !result.Allowed {
+		h.Set("Retry-After", strconv.Itoa(int(math.Max(float64(reset), 1))))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisRateLimitTimeout = 50 * time.Millisecond
+
+// gcraScript implements the generic cell rate algorithm. Every key holds the
+// theoretical arrival time (TAT) of the next request of a bucket in
+// microseconds. A token is taken from every bucket, or from none of them
+// when any is empty. Time is taken from the Redis server, so that the clocks
+// of gateway replicas don't matter; scripts replicate their effects, which
+// needs Redis 5 or later.
+//
+//	KEYS[i]      bucket keys
+//	ARGV[2i-1]   emission interval of bucket i, the time one token takes to
+//	             refill (us)
+//	ARGV[2i]     burst capacity of bucket i (tokens)
+//
+// It returns {allowed, remaining, retry after (us)} for every bucket, one
+// after the other.
+var gcraScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local results, tats, admitted = {}, {}, true
+for i, key in ipairs(KEYS) do
+	local interval = tonumber(ARGV[2 * i - 1])
+	local tolerance = interval * tonumber(ARGV[2 * i])
+
+	local tat = tonumber(redis.call('GET', key) or now)
+	if tat < now then
+		tat = now
+	end
+
+	local new_tat = tat + interval
+	if new_tat - now > tolerance then
+		admitted = false
+		table.insert(results, 0)
+		table.insert(results, 0)
+		table.insert(results, new_tat - tolerance - now)
+	else
+		tats[i] = new_tat
+		table.insert(results, 1)
+		table.insert(results, math.floor((tolerance - (new_tat - now)) / interval))
+		table.insert(results, 0)
+	end
+end
+
+if admitted then
+	for i, key in ipairs(KEYS) do
+		redis.call('SET', key, string.format('%d', tats[i]), 'PX', math.ceil((tats[i] - now) / 1000))
+	end
+end
+return results
+`)
+
+// RedisRateLimitBackend keeps GCRA state in Redis so that limits hold across
+// every gateway replica. Any client speaking the Redis protocol works,
+// including an in-process fake. The buckets of a check are updated by a
+// single script, so Redis Cluster isn't supported.
+type RedisRateLimitBackend struct {
+	client redis.Scripter
+	prefix string
+}
+
+func NewRedisRateLimitBackend(client redis.Scripter, prefix string) *RedisRateLimitBackend {
+	return &RedisRateLimitBackend{client: client, prefix: prefix}
+}
+
+// Allow takes a token from every bucket of keys, or from none of them when
+// any is empty.
+func (r *RedisRateLimitBackend) Allow(ctx context.Context, keys []string, limits []Limit) ([]RateLimitResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisRateLimitTimeout)
+	defer cancel()
+
+	prefixed := make([]string, len(keys))
+	args := make([]interface{}, 0, 2*len(keys))
+	for i, key := range keys {
+		prefixed[i] = r.prefix + key
+		interval := int64(math.Ceil(float64(time.Second/time.Microsecond) / limits[i].Rate))
+		args = append(args, interval, int64(limits[i].burst()))
+	}
+	values, err := gcraScript.Run(ctx, r.client, prefixed, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 3*len(keys) {
+		return nil, fmt.Errorf("ratelimit: unexpected script result %v", values)
+	}
+
+	results := make([]RateLimitResult, len(keys))
+	for i := range keys {
+		results[i] = RateLimitResult{
+			Allowed:   values[3*i] == 1,
+			Limit:     int(math.Ceil(limits[i].Rate)),
+			Remaining: int(values[3*i+1]),
+			Reset:     time.Duration(values[3*i+2]) * time.Microsecond,
+		}
+	}
+	return results, nil
+}
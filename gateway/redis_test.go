@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis starts a fake Redis server whose clock is frozen at now.
+func newTestRedis(t *testing.T, now time.Time) (*miniredis.Miniredis, *RedisRateLimitBackend) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	server.SetTime(now)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, NewRedisRateLimitBackend(client, "test:")
+}
+
+func allowOne(t *testing.T, backend RateLimitBackend, key string, limit Limit) RateLimitResult {
+	t.Helper()
+	results, err := backend.Allow(context.Background(), []string{key}, []Limit{limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results[0]
+}
+
+func TestRedisRateLimitAllowAndDeny(t *testing.T) {
+	_, backend := newTestRedis(t, time.Unix(1700000000, 0))
+	limit := Limit{Rate: 2, Burst: 3}
+
+	for i, remaining := range []int{2, 1, 0} {
+		result := allowOne(t, backend, "project:a", limit)
+		if !result.Allowed || result.Remaining != remaining || result.Limit != 2 {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", i, result, remaining)
+		}
+	}
+	if result := allowOne(t, backend, "project:a", limit); result.Allowed {
+		t.Fatalf("request over the burst: got %+v, want denied", result)
+	}
+	if result := allowOne(t, backend, "project:b", limit); !result.Allowed {
+		t.Fatalf("other bucket: got %+v, want allowed", result)
+	}
+}
+
+func TestRedisRateLimitRetryAfter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	server, backend := newTestRedis(t, now)
+	limit := Limit{Rate: 2, Burst: 2}
+
+	allowOne(t, backend, "chain:c", limit)
+	allowOne(t, backend, "chain:c", limit)
+	result := allowOne(t, backend, "chain:c", limit)
+	if result.Allowed || result.Reset != 500*time.Millisecond {
+		t.Fatalf("got %+v, want denied with a 500ms reset", result)
+	}
+
+	server.SetTime(now.Add(499 * time.Millisecond))
+	if result := allowOne(t, backend, "chain:c", limit); result.Allowed {
+		t.Fatalf("before the reset: got %+v, want denied", result)
+	}
+	server.SetTime(now.Add(500 * time.Millisecond))
+	if result := allowOne(t, backend, "chain:c", limit); !result.Allowed {
+		t.Fatalf("after the reset: got %+v, want allowed", result)
+	}
+}
+
+func TestRedisRateLimitSharedKey(t *testing.T) {
+	server, _ := newTestRedis(t, time.Unix(1700000000, 0))
+	limit := Limit{Rate: 1, Burst: 5}
+
+	// Every replica has its own client, the bucket is shared in Redis.
+	var limiters []*RateLimiter
+	for i := 0; i < 3; i++ {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		limiters = append(limiters, NewRateLimiter(NewRedisRateLimitBackend(client, "test:")))
+	}
+
+	allowed := 0
+	for i := 0; i < 12; i++ {
+		result := limiters[i%len(limiters)].Check(context.Background(), "c", "p", RouteLimits{Project: limit})
+		if result.Allowed {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Fatalf("got %d allowed requests across replicas, want the burst of 5", allowed)
+	}
+}
+
+func TestRedisRateLimitDeniedChainKeepsProjectTokens(t *testing.T) {
+	_, backend := newTestRedis(t, time.Unix(1700000000, 0))
+	limiter := NewRateLimiter(backend)
+	limits := RouteLimits{Project: Limit{Rate: 1, Burst: 3}, Chain: Limit{Rate: 1, Burst: 1}}
+
+	if result := limiter.Check(context.Background(), "c", "p", limits); !result.Allowed {
+		t.Fatalf("first request: got %+v, want allowed", result)
+	}
+	for i := 0; i < 3; i++ {
+		if result := limiter.Check(context.Background(), "c", "p", limits); result.Allowed {
+			t.Fatalf("request %d: got %+v, want denied by the chain limit", i, result)
+		}
+	}
+	// The project only spent the token of the admitted request.
+	if result := allowOne(t, backend, "project:p", limits.Project); !result.Allowed || result.Remaining != 1 {
+		t.Fatalf("project bucket: got %+v, want allowed with 1 remaining", result)
+	}
+}
+
+func TestRedisURLValidation(t *testing.T) {
+	cfg := RateLimitConfig{Backend: "redis", RedisURL: "localhost:6379"}
+	if _, err := newRateLimitBackend(cfg); err == nil {
+		t.Fatal("newRateLimitBackend: got no error for a URL without scheme")
+	}
+	if err := (&Config{RateLimit: cfg}).Validate(); err == nil || !strings.Contains(err.Error(), "ratelimit.redisurl") {
+		t.Fatalf("Validate: got %v, want a ratelimit.redisurl error", err)
+	}
+
+	cfg.RedisURL = "redis://:password@localhost:6379/0"
+	if _, err := newRateLimitBackend(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
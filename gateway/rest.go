@@ -3,27 +3,27 @@ package main
 import (
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"regexp"
+	"strconv"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 type RestProxy struct {
-	Proxy *httputil.ReverseProxy
+	Proxy     *httputil.ReverseProxy
+	Upstreams *UpstreamPool
 }
 
-func NewRestProxy(target *url.URL) *RestProxy {
+func NewRestProxy(upstreams *UpstreamPool) *RestProxy {
 	// proxy := httputil.NewSingleHostReverseProxy(target)
 	director := func(req *http.Request) {
+		target := upstreamFromContext(req.Context()).URL
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		// - v2 cosmos rest via gRPC-gateway
 		//    /lcd/myriad/sbbdluuarbc524e9h3zd2fu4macyl306/cosmos/bank/v1beta1/balances/{address}
 		//    --> /cosmos/bank/v1beta1/balances/{address}
-		re := regexp.MustCompile(v2PathRegex)
-		params := re.FindStringSubmatch(req.URL.Path)
+		params := v2PathRe.FindStringSubmatch(req.URL.Path)
 		if len(params) == 5 {
 			req.URL.Path = params[4]
 			req.URL.RawPath = params[4]
@@ -33,11 +33,20 @@ func NewRestProxy(target *url.URL) *RestProxy {
 			req.URL.RawQuery = target.RawQuery
 		}
 	}
-	proxy := &httputil.ReverseProxy{Director: director}
-	return &RestProxy{Proxy: proxy}
+	proxy := &httputil.ReverseProxy{Director: director, Transport: DefaultTransport, ModifyResponse: stripCORSHeaders}
+	return &RestProxy{Proxy: proxy, Upstreams: upstreams}
 }
 
 func (h *RestProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	upstream := h.Upstreams.Pick()
+	if upstream == nil {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	release := upstream.acquire()
+	defer release()
+	req = req.WithContext(withUpstream(req.Context(), upstream))
+
 	prw := &RestProxyResponseWriter{
 		ResponseWriter: rw,
 		responseSize:   0,
@@ -46,6 +55,10 @@ func (h *RestProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ts := time.Now()
 
 	h.Proxy.ServeHTTP(prw, req)
+	if req.Context().Err() == nil {
+		upstream.Report(prw.statusCode >= http.StatusInternalServerError, time.Since(ts))
+	}
+	observeRouted(req.Context(), false, req.Method, strconv.Itoa(prw.statusCode), time.Since(ts))
 
 	zap.S().Infow("request",
 		"path", req.RequestURI,
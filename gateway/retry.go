@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls failover of idempotent JSON-RPC calls.
+type RetryPolicy struct {
+	// MaxRetries is the number of alternate upstreams tried per request.
+	MaxRetries int
+	// BudgetRatio is the share of requests that may be retried.
+	BudgetRatio float64
+	// BudgetMinPerSecond allows a few retries even at very low traffic.
+	BudgetMinPerSecond float64
+	// BudgetMax caps the retries that can be saved up.
+	BudgetMax float64
+}
+
+// DefaultRetryPolicy is used by every JSON-RPC proxy.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxRetries:         2,
+	BudgetRatio:        0.2,
+	BudgetMinPerSecond: 1,
+	BudgetMax:          20,
+}
+
+// idempotentMethods are the read-only methods that may be sent to another
+// upstream when the first one fails. A trailing * matches any suffix. Methods
+// that submit transactions, manage filters or change node state must never
+// be listed here.
+var idempotentMethods = []string{
+	// substrate
+	"state_get*",
+	"state_call",
+	"state_queryStorageAt",
+	"chain_get*",
+	"system_chain",
+	"system_chainType",
+	"system_health",
+	"system_name",
+	"system_properties",
+	"system_version",
+	"rpc_methods",
+	"payment_queryInfo",
+	"payment_queryFeeDetails",
+	// evm
+	"eth_blockNumber",
+	"eth_call",
+	"eth_chainId",
+	"eth_estimateGas",
+	"eth_feeHistory",
+	"eth_gasPrice",
+	"eth_getBalance",
+	"eth_getBlockByHash",
+	"eth_getBlockByNumber",
+	"eth_getBlockTransactionCountByHash",
+	"eth_getBlockTransactionCountByNumber",
+	"eth_getCode",
+	"eth_getLogs",
+	"eth_getProof",
+	"eth_getStorageAt",
+	"eth_getTransactionByBlockHashAndIndex",
+	"eth_getTransactionByBlockNumberAndIndex",
+	"eth_getTransactionByHash",
+	"eth_getTransactionCount",
+	"eth_getTransactionReceipt",
+	"eth_maxPriorityFeePerGas",
+	"eth_syncing",
+	"net_version",
+	"web3_clientVersion",
+}
+
+// matchMethod reports whether method matches pattern, where a trailing *
+// matches any suffix.
+func matchMethod(pattern, method string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(method, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == method
+}
+
+func matchAnyMethod(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if matchMethod(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdempotent reports whether a parsed request, or every request of a
+// batch, only calls read-only methods.
+func isIdempotent(req interface{}) bool {
+	switch r := req.(type) {
+	case JsonRpcRequest:
+		return matchAnyMethod(idempotentMethods, r.Method)
+	case []JsonRpcRequest:
+		for _, x := range r {
+			if !matchAnyMethod(idempotentMethods, x.Method) {
+				return false
+			}
+		}
+		return len(r) > 0
+	}
+	return false
+}
+
+// shouldRetry reports whether the outcome of a round trip is worth trying on
+// another upstream.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// RetryBudget limits retries to a share of the traffic, so that retries
+// can't multiply the load on upstreams during an outage.
+type RetryBudget struct {
+	policy *RetryPolicy
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewRetryBudget(policy *RetryPolicy) *RetryBudget {
+	return &RetryBudget{policy: policy, tokens: policy.BudgetMax, last: time.Now()}
+}
+
+// Deposit is called for every request.
+func (b *RetryBudget) Deposit() {
+	b.mu.Lock()
+	b.add(b.policy.BudgetRatio)
+	b.mu.Unlock()
+}
+
+// Withdraw reports whether a retry is allowed and spends it.
+func (b *RetryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.add(now.Sub(b.last).Seconds() * b.policy.BudgetMinPerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *RetryBudget) add(tokens float64) {
+	b.tokens += tokens
+	if b.tokens > b.policy.BudgetMax {
+		b.tokens = b.policy.BudgetMax
+	}
+}
+
+// retryRequest copies req for another attempt against upstream.
+func retryRequest(req *http.Request, upstream *Upstream) (*http.Request, error) {
+	if req.GetBody == nil {
+		return nil, errors.New("rpc: request body can't be replayed")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.Clone(withUpstream(req.Context(), upstream))
+	r.Body = body
+	r.URL.Scheme = upstream.URL.Scheme
+	r.URL.Host = upstream.URL.Host
+	r.URL.Path = upstream.URL.Path
+	r.URL.RawPath = upstream.URL.RawPath
+	r.URL.RawQuery = upstream.URL.RawQuery
+	return r, nil
+}
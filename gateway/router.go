@@ -1,35 +1,43 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-// const rateLimitPath = "/limit"
 const healthCheckPath = "/health"
-const clearRoutesPath = "/clear"
 const v1PathRegex = `^/(?P<chain>[a-z][-a-z0-9]*[a-z0-9]?)/(?P<project>[a-z0-9]{32}|[a-z0-9]{16})$`
-const v2PathRegex = `^/(rpc|lcd|eth)/(?P<chain>[a-z][-a-z0-9]*[a-z0-9]?)/(?P<project>[a-z0-9]{32}|[a-z0-9]{16})(?:\/|$)(?P<path>[^?#]*)$`
+
+var v1PathRe = regexp.MustCompile(v1PathRegex)
 
 type (
+	// Proxy holds the handlers of a chain by protocol prefix.
 	Proxy struct {
-		rpc     *JsonRpcProxy
-		ws      *WebsocketProxy
-		rest    *RestProxy
-		eth_rpc *JsonRpcProxy
-		eth_ws  *WebsocketProxy
+		protocols map[string]*protocolProxy
+		// fingerprint identifies the balancer and targets the proxy was
+		// built from, fetched when the route lookup was made.
+		fingerprint string
+		fetched     time.Time
 	}
 
 	Router struct {
 		routes       sync.Map
-		routeChecker string
+		routeChecker *RouteChecker
+		limiter      *RateLimiter
+		quotas       *QuotaTracker
+		ipFilter     *IPFilter
+		hosts        *HostRoutes
+		draining     atomic.Bool
 	}
 
 	RouteResponse struct {
@@ -42,12 +50,105 @@ type (
 			ETH_RPC string `json:"eth_rpc"`
 			ETH_WS  string `json:"eth_ws"`
 		} `json:"target"`
+		Balancer  string                      `json:"balancer"`
+		Upstreams map[string][]UpstreamTarget `json:"upstreams"`
+		Limits    RouteLimits                 `json:"limits"`
+		Quota     RouteQuota                  `json:"quota"`
+		// Methods are the JSON-RPC method policies by path prefix (rpc, eth).
+		Methods map[string]MethodPolicy `json:"methods"`
+		Auth    RouteAuth               `json:"auth"`
+		// Origins, when not empty, are the only origins browsers may use the
+		// project from.
+		Origins []string  `json:"origins"`
+		IPs     RouteIPs  `json:"ips"`
+		CORS    RouteCORS `json:"cors"`
+
+		fetched time.Time
 	}
+
+	UpstreamTarget struct {
+		URL    string `json:"url"`
+		Weight int    `json:"weight"`
+	}
+
+	// routeInfo is attached to the context of routed requests.
+	routeInfo struct {
+		chain    string
+		project  string
+		protocol string // rpc, lcd or eth
+		response *RouteResponse
+		claims   *TokenClaims // nil without access token
+
+		// rpcMethods are the ids of rpc_methods calls sent over a WebSocket
+		// whose result hasn't been filtered yet.
+		mu         sync.Mutex
+		rpcMethods []string
+	}
+
+	routeInfoKey struct{}
 )
 
-func NewRouter(routeChecker string) *Router {
+// Targets returns the weighted upstreams for a protocol (rpc, ws, grpc, rest,
+// eth_rpc, eth_ws), falling back to the single legacy target when the API
+// doesn't report a list.
+func (r *RouteResponse) Targets(protocol string) []UpstreamTarget {
+	if targets := r.Upstreams[protocol]; len(targets) > 0 {
+		return targets
+	}
+
+	var target string
+	switch protocol {
+	case "rpc":
+		target = r.Target.RPC
+	case "ws":
+		target = r.Target.WS
+	case "grpc":
+		target = r.Target.GRPC
+	case "rest":
+		target = r.Target.REST
+	case "eth_rpc":
+		target = r.Target.ETH_RPC
+	case "eth_ws":
+		target = r.Target.ETH_WS
+	}
+	if target == "" {
+		return nil
+	}
+	return []UpstreamTarget{{URL: target, Weight: 1}}
+}
+
+// fingerprint identifies the balancer and the targets of every protocol of
+// the route.
+func (r *RouteResponse) fingerprint() string {
+	prefixes := make([]string, 0, len(protocols))
+	for prefix := range protocols {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	var b strings.Builder
+	b.WriteString(r.Balancer)
+	for _, prefix := range prefixes {
+		for _, target := range []string{protocols[prefix].HTTPTarget, protocols[prefix].WSTarget} {
+			if target == "" {
+				continue
+			}
+			fmt.Fprintf(&b, "|%s=", target)
+			for _, t := range r.Targets(target) {
+				fmt.Fprintf(&b, "%s*%d,", t.URL, t.Weight)
+			}
+		}
+	}
+	return b.String()
+}
+
+func NewRouter(routeChecker *RouteChecker, limiter *RateLimiter, quotas *QuotaTracker, ipFilter *IPFilter, hosts *HostRoutes) *Router {
 	return &Router{
 		routeChecker: routeChecker,
+		limiter:      limiter,
+		quotas:       quotas,
+		ipFilter:     ipFilter,
+		hosts:        hosts,
 	}
 }
 
@@ -55,27 +156,34 @@ func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// Health Check
 	if req.URL.Path == healthCheckPath {
 		zap.S().Infow("health", "path", req.URL.Path)
+		if r.draining.Load() {
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(rw, http.StatusText(http.StatusOK), http.StatusOK)
 		return
 	}
 
-	// Clear Routes
-	if req.URL.Path == clearRoutesPath {
-		zap.S().Infow("clear", "path", req.URL.Path)
-		r.routes.Range(func(key, value interface{}) bool {
-			// proxy := value.(*Proxy)
-			// proxy.rpc = nil
-			// proxy.ws = nil
-			// proxy.rest = nil
-			// proxy.eth_rpc = nil
-			// proxy.eth_ws = nil
-			r.routes.Delete(key)
-			return true
-		})
-		http.Error(rw, http.StatusText(http.StatusOK), http.StatusOK)
+	// Count the requests the Router answers itself, the proxies count the
+	// others
+	proxied := rw
+	recorder := &statusRecorder{ResponseWriter: rw}
+	defer recorder.count("http")
+	rw = recorder
+
+	// Block clients on the global denylist
+	clientIP := r.ipFilter.ClientIP(req.RemoteAddr, req.Header.Values("X-Forwarded-For"))
+	if r.ipFilter.Denied(clientIP) {
+		zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusForbidden, "ip", clientIP)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
 
+	// Requests to gateway domains are routed like their v2 path
+	if path, ok := r.hosts.rewrite(req.Host, req.URL.Path); ok {
+		req.URL.Path, req.URL.RawPath = path, ""
+	}
+
 	// - v1 json-rpc
 	//    POST /myriad/sbbdluuarbc524e9h3zd2fu4macyl306
 	// - v2 json-rpc (websocket)
@@ -84,32 +192,26 @@ func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	//    GET  /lcd/myriad/sbbdluuarbc524e9h3zd2fu4macyl306/cosmos/bank/v1beta1/balances/{address}
 	// - v2 evm json-rpc (websocket)
 	//    POST /eth/myriad/sbbdluuarbc524e9h3zd2fu4macyl306[/websocket]
-	isJsonRpc := true
-	isEvmChain := false
-	v1re, v2re := regexp.MustCompile(v1PathRegex), regexp.MustCompile(v2PathRegex)
-	params := v1re.FindStringSubmatch(req.URL.Path)
+	// - v2 paths of other registered protocols
+	//    /{prefix}/myriad/sbbdluuarbc524e9h3zd2fu4macyl306[/path]
+	protocol := protocols["rpc"]
+	params := v1PathRe.FindStringSubmatch(req.URL.Path)
 	if len(params) != 3 {
-		params = v2re.FindStringSubmatch(req.URL.Path)
+		params = v2PathRe.FindStringSubmatch(req.URL.Path)
 		if len(params) != 5 {
 			zap.S().Errorw("router", "path", req.URL.Path, "status", http.StatusBadRequest)
 			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
-		if params[1] == "lcd" {
-			isJsonRpc = false
-		}
-		if params[1] == "eth" {
-			isEvmChain = true
-		}
+		protocol = protocols[params[1]]
+		params = params[1:]
 	}
 	chain, project := params[1], params[2]
-	if len(params) == 5 && (params[1] == "lcd" || params[1] == "rpc" || params[1] == "eth") {
-		chain, project = params[2], params[3]
-	}
+	websocket := isWebsocket(req)
 
 	// Check if the request should be routed
-	routeResp := RouteResponse{}
-	if err := r.shouldRoute(chain, project, &routeResp); err != nil {
+	routeResp, err := r.routeChecker.Check(chain, project)
+	if err != nil {
 		zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusInternalServerError)
 		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
@@ -121,107 +223,339 @@ func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Create proxy if it does not exist
-	value, ok := r.routes.Load(chain)
-	if !ok {
-		value = r.addRoute(chain, routeResp.Target.RPC, routeResp.Target.WS,
-			routeResp.Target.REST, routeResp.Target.ETH_RPC, routeResp.Target.ETH_WS)
+	// Only serve the protocols the chain has upstreams for
+	target := protocol.target(websocket)
+	if target == "" || len(routeResp.Targets(target)) == 0 {
+		zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusNotFound, "protocol", protocol.Name)
+		http.Error(rw, protocol.unsupported(websocket), http.StatusNotFound)
+		return
+	}
+
+	// Only serve the project to the client IPs it allows
+	if !routeResp.IPs.Allowed(clientIP) {
+		zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusForbidden, "ip", clientIP)
+		http.Error(rw, fmt.Sprintf("Client IP %s is not allowed for this project", clientIP), http.StatusForbidden)
+		return
+	}
+
+	// Only serve the project to the origins it allows
+	if len(routeResp.Origins) > 0 {
+		origin := requestOrigin(req.Header.Get("Origin"), req.Referer())
+		if !originAllowed(routeResp.Origins, origin) {
+			zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusForbidden, "origin", origin)
+			message := fmt.Sprintf("Origin %q is not allowed for this project", origin)
+			if origin == "" {
+				message = "An Origin or Referer header is required for this project"
+			}
+			http.Error(rw, message, http.StatusForbidden)
+			return
+		}
+	}
+
+	// Set the CORS headers of JSON-RPC and LCD responses and answer
+	// preflights, which carry no credentials, without the upstreams
+	if !websocket {
+		setCORSHeaders(rw.Header(), req, routeResp.CORS, routeResp.Origins)
+		if isPreflight(req) {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	// Authenticate with the project secret, an access token or a client
+	// certificate issued to the project
+	claims, err := routeResp.Auth.authenticate(projectSecret(req), accessToken(req), chain, project)
+	if err != nil && clientCertProject(req.TLS, project) {
+		claims, err = nil, nil
+	}
+	if err != nil {
+		zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusUnauthorized, "error", err)
+		rw.Header().Set("WWW-Authenticate", `Basic realm="octopus-gateway"`)
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
 	}
-	if value == nil {
-		zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusNotFound)
-		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	stripProjectSecret(req)
+	stripAccessToken(req)
+
+	// Rate limit the project and the chain
+	result := r.limiter.Check(req.Context(), chain, project, routeResp.Limits)
+	setRateLimitHeaders(rw.Header(), result)
+	if !result.Allowed {
+		zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusTooManyRequests)
+		writeJsonRpcError(rw, http.StatusTooManyRequests, errRateLimited)
 		return
 	}
-	proxy := value.(*Proxy)
+
+	// Count the request against the project's quotas
+	if quota := r.quotas.Check(project, routeResp); quota != nil {
+		if quota.exceeded {
+			zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusTooManyRequests, "quota", quota.Period)
+			writeJsonRpcError(rw, http.StatusTooManyRequests, quotaExceededError(quota))
+			return
+		}
+		rw.Header().Set("X-Quota-Warning", quota.String())
+	}
+	info := &routeInfo{chain: chain, project: project, protocol: protocol.Prefix, response: routeResp, claims: claims}
+	req = req.WithContext(context.WithValue(req.Context(), routeInfoKey{}, info))
+
+	// Remove the calls the chain's method policy doesn't allow
+	if protocol.JsonRpc && req.Method == http.MethodPost {
+		filtered, ok := filterMethods(rw, req, info.methodFilter())
+		if !ok {
+			zap.S().Errorw("router", "path", req.URL.Path, "statue", http.StatusOK, "methods", "denied")
+			return
+		}
+		req = filtered
+	}
+
+	// Create proxy if it does not exist, or replace it when a newer lookup
+	// reports different upstreams
+	value, ok := r.routes.Load(chain)
+	if !ok {
+		value = r.addRoute(chain, routeResp, nil)
+	} else if old := value.(*Proxy); old.stale(routeResp) {
+		value = r.addRoute(chain, routeResp, old)
+	}
+	handlers := value.(*Proxy).protocols[protocol.Prefix]
 
 	// Route request
-	switch req.URL.Scheme {
-	case "http":
-	case "https":
-		if isJsonRpc {
-			if isEvmChain {
-				zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.ETH_RPC)
-				proxy.eth_rpc.ServeHTTP(rw, req)
-			} else {
-				zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.RPC)
-				proxy.rpc.ServeHTTP(rw, req)
+	zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Targets(target)[0].URL)
+	if websocket && handlers.websocket != nil {
+		handlers.websocket.ServeHTTP(proxied, req)
+	} else if !websocket && handlers.http != nil {
+		handlers.http.ServeHTTP(proxied, req)
+	} else {
+		// The proxy was created from an older lookup of the route.
+		http.Error(rw, protocol.unsupported(websocket), http.StatusNotFound)
+	}
+}
+
+// Drain fails the health check from now on, so that load balancers stop
+// sending new clients before the gateway shuts down.
+func (r *Router) Drain() {
+	r.draining.Store(true)
+}
+
+// Evict drops the cached routes of a chain and/or a project, an empty chain
+// or project matches any. The proxies of evicted chains are recreated from
+// the next lookup.
+func (r *Router) Evict(chain, project string) {
+	r.routeChecker.Evict(chain, project)
+	if project != "" && chain == "" {
+		return
+	}
+	r.routes.Range(func(key, value interface{}) bool {
+		if chain == "" || key == chain {
+			if value, ok := r.routes.LoadAndDelete(key); ok {
+				value.(*Proxy).Close()
 			}
-		} else {
-			zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.REST)
-			proxy.rest.ServeHTTP(rw, req)
 		}
-	case "ws":
-	case "wss":
-		if isEvmChain {
-			zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.ETH_WS)
-			proxy.eth_ws.ServeHTTP(rw, req)
-		} else {
-			zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.WS)
-			proxy.ws.ServeHTTP(rw, req)
-		}
-	default:
-		// TODO: connection := req.Header.Get("Connection")
-		if upgrade := req.Header.Get("Upgrade"); upgrade == "websocket" {
-			if isEvmChain {
-				zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.ETH_WS)
-				proxy.eth_ws.ServeHTTP(rw, req)
-			} else {
-				zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.WS)
-				proxy.ws.ServeHTTP(rw, req)
+		return true
+	})
+}
+
+// Upstreams describes the upstreams of the loaded proxies.
+func (r *Router) Upstreams() []AdminUpstream {
+	upstreams := []AdminUpstream{}
+	r.routes.Range(func(key, value interface{}) bool {
+		for prefix, handlers := range value.(*Proxy).protocols {
+			if handlers.httpPool != nil {
+				upstreams = append(upstreams, adminUpstreams(key.(string), protocols[prefix].HTTPTarget, handlers.httpPool)...)
+			}
+			if handlers.websocket != nil {
+				upstreams = append(upstreams, adminUpstreams(key.(string), protocols[prefix].WSTarget, handlers.websocket.Upstreams)...)
 			}
-		} else {
-			if isJsonRpc {
-				if isEvmChain {
-					zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.ETH_RPC)
-					proxy.eth_rpc.ServeHTTP(rw, req)
-				} else {
-					zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.RPC)
-					proxy.rpc.ServeHTTP(rw, req)
-				}
-			} else {
-				zap.S().Infow("router", "path", req.URL.Path, "target", routeResp.Target.REST)
-				proxy.rest.ServeHTTP(rw, req)
+		}
+		return true
+	})
+	sort.Slice(upstreams, func(i, j int) bool {
+		a, b := upstreams[i], upstreams[j]
+		if a.Chain != b.Chain {
+			return a.Chain < b.Chain
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Target < b.Target
+	})
+	return upstreams
+}
+
+// addRoute creates the handlers of every protocol the chain has upstreams
+// for and stores them in place of old, nil when the chain has no proxy yet.
+// Requests and WebSocket sessions already served by old carry on with its
+// upstreams, which keep their health and circuit breaker state when the new
+// proxy still uses them.
+func (r *Router) addRoute(chain string, routeResp *RouteResponse, old *Proxy) *Proxy {
+	balancer := routeResp.Balancer
+	proxy := &Proxy{
+		protocols:   make(map[string]*protocolProxy, len(protocols)),
+		fingerprint: routeResp.fingerprint(),
+		fetched:     routeResp.fetched,
+	}
+	for prefix, protocol := range protocols {
+		handlers := &protocolProxy{}
+		if targets := routeResp.Targets(protocol.HTTPTarget); len(targets) > 0 {
+			handlers.httpPool = NewUpstreamPool(balancer, targets)
+			handlers.http = protocol.NewHandler(handlers.httpPool)
+		}
+		if targets := routeResp.Targets(protocol.WSTarget); protocol.WSTarget != "" && len(targets) > 0 {
+			handlers.websocket = NewWebsocketProxy(NewUpstreamPool(balancer, targets))
+			if protocol.JsonRpc {
+				handlers.websocket.Admit, handlers.websocket.Filter = r.admitMessage, r.filterMessage
 			}
 		}
+		if old != nil && old.protocols[prefix] != nil {
+			handlers.inherit(old.protocols[prefix])
+		}
+		proxy.protocols[prefix] = handlers
+	}
+
+	if old == nil {
+		if actual, loaded := r.routes.LoadOrStore(chain, proxy); loaded {
+			return actual.(*Proxy)
+		}
+	} else if !r.routes.CompareAndSwap(chain, old, proxy) {
+		// Another request replaced or evicted the proxy first.
+		if actual, ok := r.routes.Load(chain); ok {
+			return actual.(*Proxy)
+		}
+		return r.addRoute(chain, routeResp, nil)
+	}
+
+	for prefix, handlers := range proxy.protocols {
+		for _, pool := range handlers.pools() {
+			pool.StartHealthChecks(protocols[prefix].Probe)
+		}
+	}
+	if old != nil {
+		zap.S().Infow("router", "chain", chain, "proxy", "replaced", "fingerprint", proxy.fingerprint)
+		old.Close()
 	}
+	return proxy
 }
 
-func (r *Router) addRoute(chain string, rpc, ws, rest, eth_rpc, eth_ws string) interface{} {
-	u1, _ := url.Parse(rpc)
-	u2, _ := url.Parse(ws)
-	u3, _ := url.Parse(rest)
-	u4, _ := url.Parse(eth_rpc)
-	u5, _ := url.Parse(eth_ws)
-	if u1 == nil {
-		return nil
+// admitMessage applies the rate limits, quotas and method policy of the route
+// to every message a WebSocket client sends.
+func (r *Router) admitMessage(req *http.Request, msg []byte) ([]byte, []byte) {
+	info, ok := req.Context().Value(routeInfoKey{}).(*routeInfo)
+	if !ok {
+		return msg, nil
+	}
+	if result := r.limiter.Check(req.Context(), info.chain, info.project, info.response.Limits); !result.Allowed {
+		return nil, rejectMessage(msg, errRateLimited)
+	}
+	if quota := r.quotas.Check(info.project, info.response); quota != nil && quota.exceeded {
+		return nil, rejectMessage(msg, quotaExceededError(quota))
+	}
+
+	if info.claims.Expired() {
+		return nil, rejectMessage(msg, errTokenExpired)
 	}
 
-	proxy := &Proxy{rpc: NewJsonRpcProxy(u1)}
-	if u2 != nil {
-		proxy.ws = NewWebsocketProxy(u2)
+	allowed := info.methodFilter()
+	if allowed == nil {
+		return msg, nil
 	}
-	if u3 != nil {
-		proxy.rest = NewRestProxy(u3)
+	forward, denied, ids, err := filterRequest(msg, allowed)
+	if err != nil {
+		data, _ := json.Marshal(newJsonRpcErrorResponse(nil, errParse))
+		return nil, data
 	}
-	if u4 != nil {
-		proxy.eth_rpc = NewJsonRpcProxy(u4)
+	if len(ids) > 0 {
+		info.mu.Lock()
+		info.rpcMethods = append(info.rpcMethods, ids...)
+		info.mu.Unlock()
 	}
-	if u5 != nil {
-		proxy.eth_ws = NewWebsocketProxy(u5)
+	// The denied calls of a batch are answered in a batch of their own.
+	var reply []byte
+	if len(denied) > 0 {
+		reply = marshalDenied(msg, denied)
 	}
-	actual, _ := r.routes.LoadOrStore(chain, proxy)
-	return actual
+	return forward, reply
 }
 
-func (r *Router) shouldRoute(chain, project string, target interface{}) error {
-	client := &http.Client{Timeout: 1 * time.Second}
-	// Route URL: http://gateway-api/route/{chain_id}/{project_id}
-	url := fmt.Sprintf("%s/%s/%s", r.routeChecker, chain, project)
-	resp, err := client.Get(url)
+// filterMessage removes the methods the route's policy doesn't allow from
+// the results of rpc_methods calls sent over a WebSocket.
+func (r *Router) filterMessage(req *http.Request, msg []byte) []byte {
+	info, ok := req.Context().Value(routeInfoKey{}).(*routeInfo)
+	if !ok {
+		return msg
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if len(info.rpcMethods) == 0 {
+		return msg
+	}
+
+	filtered, err := filterResponse(msg, info.methodFilter(), info.rpcMethods, nil)
 	if err != nil {
-		return err
+		return msg
+	}
+	for _, id := range responseIds(msg) {
+		for i, x := range info.rpcMethods {
+			if x == id {
+				info.rpcMethods = append(info.rpcMethods[:i], info.rpcMethods[i+1:]...)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// rejectMessage answers a WebSocket message with a JSON-RPC error.
+func rejectMessage(msg []byte, e *JsonRpcError) []byte {
+	var request JsonRpcRequest
+	json.Unmarshal(msg, &request)
+	data, _ := json.Marshal(newJsonRpcErrorResponse(request.Id, e))
+	return data
+}
+
+// methodFilter returns whether a method may be called under the route's
+// method policy and the access token, nil when every method may.
+func (info *routeInfo) methodFilter() func(string) bool {
+	policy := info.response.Methods[info.protocol]
+	if policy.Empty() && (info.claims == nil || len(info.claims.Methods) == 0) {
+		return nil
+	}
+	return func(method string) bool {
+		return policy.Allowed(method) && info.claims.MethodAllowed(method)
+	}
+}
+
+// stale reports whether the proxy should be rebuilt from routeResp: the
+// lookup is more recent than the one the proxy was built from and reports a
+// different balancer or targets.
+func (p *Proxy) stale(routeResp *RouteResponse) bool {
+	return routeResp.fetched.After(p.fetched) && routeResp.fingerprint() != p.fingerprint
+}
+
+// Close stops the background work of the proxy's upstream pools.
+func (p *Proxy) Close() {
+	for _, handlers := range p.protocols {
+		for _, pool := range handlers.pools() {
+			pool.Close()
+		}
+	}
+}
+
+// inherit carries the state of the upstreams previous shares with h over.
+func (h *protocolProxy) inherit(previous *protocolProxy) {
+	if h.httpPool != nil && previous.httpPool != nil {
+		h.httpPool.inherit(previous.httpPool)
 	}
-	defer resp.Body.Close()
+	if h.websocket != nil && previous.websocket != nil {
+		h.websocket.Upstreams.inherit(previous.websocket.Upstreams)
+	}
+}
 
-	return json.NewDecoder(resp.Body).Decode(target)
+func (h *protocolProxy) pools() []*UpstreamPool {
+	var pools []*UpstreamPool
+	if h.httpPool != nil {
+		pools = append(pools, h.httpPool)
+	}
+	if h.websocket != nil {
+		pools = append(pools, h.websocket.Upstreams)
+	}
+	return pools
 }
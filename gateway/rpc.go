@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -10,7 +11,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"strconv"
 	"time"
 
 	"go.uber.org/zap"
@@ -28,8 +29,25 @@ type JsonRpcResponse struct {
 	Error  interface{}      `json:"error"`
 }
 
+type JsonRpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type JsonRpcErrorResponse struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Error   *JsonRpcError    `json:"error"`
+}
+
 type JsonRpcProxyTransport struct {
 	http.RoundTripper
+
+	// Upstreams and Budget are used to fail idempotent calls over to
+	// another upstream.
+	Upstreams *UpstreamPool
+	Budget    *RetryBudget
 }
 
 type JsonRpcProxy struct {
@@ -37,32 +55,50 @@ type JsonRpcProxy struct {
 	// sends it to another server, proxying the response back to the
 	// client.
 	Proxy *httputil.ReverseProxy
+
+	// Upstreams are the nodes requests are balanced across.
+	Upstreams *UpstreamPool
 }
 
-func NewJsonRpcProxy(target *url.URL) *JsonRpcProxy {
+func NewJsonRpcProxy(upstreams *UpstreamPool) *JsonRpcProxy {
 	director := func(req *http.Request) {
+		target := upstreamFromContext(req.Context()).URL
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.URL.Path = target.Path
 		req.URL.RawPath = target.RawPath
 		req.URL.RawQuery = target.RawQuery
 	}
-	transport := &JsonRpcProxyTransport{http.DefaultTransport}
+	transport := &JsonRpcProxyTransport{
+		RoundTripper: DefaultTransport,
+		Upstreams:    upstreams,
+		Budget:       NewRetryBudget(DefaultRetryPolicy),
+	}
 	proxy := &httputil.ReverseProxy{
-		Director:  director,
-		Transport: transport,
+		Director:       director,
+		Transport:      transport,
+		ModifyResponse: filterProxyResponse,
 	}
-	return &JsonRpcProxy{Proxy: proxy}
+	return &JsonRpcProxy{Proxy: proxy, Upstreams: upstreams}
 }
 
 func (h *JsonRpcProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	h.Proxy.ServeHTTP(rw, req)
+	upstream := h.Upstreams.Pick()
+	if upstream == nil {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	release := upstream.acquire()
+	defer release()
+
+	h.Proxy.ServeHTTP(rw, req.WithContext(withUpstream(req.Context(), upstream)))
 }
 
 func (t *JsonRpcProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// 20221119 patch cors http method options
+	// Only POST requests carry JSON-RPC calls, CORS preflights are answered
+	// by the Router.
 	if req.Method != http.MethodPost {
-		return http.DefaultTransport.RoundTrip(req)
+		return t.RoundTripper.RoundTrip(req)
 	}
 
 	ts := time.Now()
@@ -71,16 +107,46 @@ func (t *JsonRpcProxyTransport) RoundTrip(req *http.Request) (*http.Response, er
 		zap.S().Errorw(fmt.Sprintf("rpc: Parse Request Error | %s", err))
 	}
 
-	resp, err := t.RoundTripper.RoundTrip(req)
+	upstream := upstreamFromContext(req.Context())
+	resp, err := t.send(req, upstream)
+
+	// Fail idempotent calls over to other upstreams, within the budget.
+	t.Budget.Deposit()
+	tried := []*Upstream{upstream}
+	for attempt := 0; attempt < DefaultRetryPolicy.MaxRetries && shouldRetry(resp, err) && isIdempotent(_req); attempt++ {
+		next := t.Upstreams.Pick(tried...)
+		if next == nil || !t.Budget.Withdraw() {
+			break
+		}
+		retryReq, rerr := retryRequest(req, next)
+		if rerr != nil {
+			zap.S().Errorw(fmt.Sprintf("rpc: Retry Error | %s", rerr))
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		zap.S().Infow("retry", "path", req.RequestURI, "attempt", attempt+1, "target", next.Target)
+
+		release := next.acquire()
+		resp, err = t.send(retryReq, next)
+		release()
+		tried, upstream = append(tried, next), next
+	}
 	if err != nil {
 		zap.S().Errorw(fmt.Sprintf("rpc: Round Trip Error | %s", err))
+		observeJsonRpc(req.Context(), _req, strconv.Itoa(http.StatusBadGateway), time.Since(ts))
 		return resp, err
 	}
+	observeJsonRpc(req.Context(), _req, strconv.Itoa(resp.StatusCode), time.Since(ts))
 
 	_resp, _len, err := parseResponse(resp)
 	if err != nil {
 		zap.S().Errorw(fmt.Sprintf("rpc: Parse Response Error | %s", err))
 	}
+	if upstream != nil && resp.StatusCode < http.StatusInternalServerError {
+		upstream.Report(hasInternalError(_resp), time.Since(ts))
+	}
 
 	if _req != nil && _resp != nil {
 		switch i := _req.(type) {
@@ -154,6 +220,77 @@ func (t *JsonRpcProxyTransport) RoundTrip(req *http.Request) (*http.Response, er
 	return resp, err
 }
 
+// send performs a single round trip to upstream and reports transport errors
+// and 5xx responses to its circuit breaker.
+func (t *JsonRpcProxyTransport) send(req *http.Request, upstream *Upstream) (*http.Response, error) {
+	ts := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if upstream == nil {
+		return resp, err
+	}
+	// Requests cancelled by the client say nothing about the upstream.
+	if err != nil && !errors.Is(err, context.Canceled) {
+		upstream.Report(true, time.Since(ts))
+	} else if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		upstream.Report(true, time.Since(ts))
+	}
+	return resp, err
+}
+
+const (
+	// JSON-RPC 2.0 internal error, returned by nodes that fail to serve a call.
+	jsonRpcInternalError = -32603
+	// Request limit exceeded, as used by EIP-1474.
+	jsonRpcLimitExceeded = -32005
+	// Implementation defined server error for rejected credentials.
+	jsonRpcUnauthorized = -32001
+)
+
+var errRateLimited = &JsonRpcError{Code: jsonRpcLimitExceeded, Message: "Rate limit exceeded"}
+
+var errTokenExpired = &JsonRpcError{Code: jsonRpcUnauthorized, Message: "Access token expired"}
+
+func quotaExceededError(quota *QuotaResult) *JsonRpcError {
+	return &JsonRpcError{Code: jsonRpcLimitExceeded, Message: "Quota exceeded", Data: quota}
+}
+
+// writeJsonRpcError answers an HTTP request with a JSON-RPC error.
+func writeJsonRpcError(rw http.ResponseWriter, status int, e *JsonRpcError) {
+	data, _ := json.Marshal(newJsonRpcErrorResponse(nil, e))
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(data)
+}
+
+func newJsonRpcErrorResponse(id *json.RawMessage, e *JsonRpcError) *JsonRpcErrorResponse {
+	return &JsonRpcErrorResponse{JsonRpc: "2.0", Id: id, Error: e}
+}
+
+// hasInternalError reports whether a parsed response, or any response of a
+// batch, carries a JSON-RPC internal error.
+func hasInternalError(resp interface{}) bool {
+	switch r := resp.(type) {
+	case JsonRpcResponse:
+		return isInternalError(r.Error)
+	case []JsonRpcResponse:
+		for _, x := range r {
+			if isInternalError(x.Error) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInternalError(e interface{}) bool {
+	m, ok := e.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	code, ok := m["code"].(float64)
+	return ok && code == jsonRpcInternalError
+}
+
 // https://github.com/polkadot-js/api/blob/master/packages/rpc-provider/src/types.ts
 // https://github.com/polkadot-js/api/blob/master/packages/rpc-provider/src/coder/index.ts
 
@@ -183,6 +320,11 @@ func parseRequest(req *http.Request) (interface{}, error) {
 		return nil, err
 	}
 
+	// Allow the body to be sent again on retries.
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(copy)), nil
+	}
+
 	var request JsonRpcRequest
 	if err = json.Unmarshal(copy, &request); err == nil {
 		req.Body = save
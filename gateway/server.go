@@ -1,44 +1,102 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
 )
 
 func main() {
 	InitLogger()
 
-	// Route URL: http://gateway-api/route/{chain_id}/{project_id}
-	routeChecker := "http://gateway-api/route"
-	if value, ok := os.LookupEnv("GATEWAY_API_ROUTE_URL"); ok {
-		routeChecker = value
+	// Config file: -config /etc/octopus-gateway/config.yaml, or config.yaml
+	// in the working directory
+	configPath := flag.String("config", os.Getenv("GATEWAY_CONFIG"), "path of the config file")
+	flag.Parse()
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln(err)
 	}
+	logLevel.UnmarshalText([]byte(cfg.LogLevel))
+
+	DefaultHealthCheck.Interval = cfg.Upstream.HealthCheckInterval
+	DefaultHealthCheck.Timeout = cfg.Upstream.HealthCheckTimeout
+	DefaultCircuitBreaker.OpenDuration = cfg.Upstream.BreakerOpenDuration
+	DefaultCircuitBreaker.SlowCallDuration = cfg.Upstream.BreakerSlowCallDuration
+	DefaultTransport = newUpstreamTransport(cfg.Upstream)
+	DefaultUpgrader.ReadBufferSize = cfg.Websocket.ReadBufferSize
+	DefaultUpgrader.WriteBufferSize = cfg.Websocket.WriteBufferSize
+	DefaultDialer.ReadBufferSize = cfg.Websocket.UpstreamReadBufferSize
+	DefaultDialer.WriteBufferSize = cfg.Websocket.UpstreamWriteBufferSize
+	DefaultDialer.HandshakeTimeout = cfg.Websocket.HandshakeTimeout
+	DefaultMaxMessageSize = cfg.Websocket.MaxMessageSize
 
-	routeService := "http"
-	if value, ok := os.LookupEnv("GATEWAY_API_ROUTE_SERVICE"); ok {
-		routeService = value
+	gateway, err := NewGateway(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	errc, err := gateway.Serve()
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	switch routeService {
-	case "http":
-		log.Println("Starting HTTP server on port 80...")
-		err := http.ListenAndServe(":80", NewRouter(routeChecker))
-		if err != nil {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-errc:
 			log.Fatalln(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				// Reload the settings that are safe to change at runtime
+				next, err := LoadConfig(*configPath)
+				if err != nil {
+					zap.S().Errorw(fmt.Sprintf("config: reload failed | %s", err))
+					continue
+				}
+				gateway.Reload(next)
+				continue
+			}
+			log.Printf("Received %s, shutting down...", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+			gateway.Shutdown(ctx)
+			cancel()
+			return
 		}
-	case "grpc":
-		grpcListener, err := net.Listen("tcp", ":81")
+	}
+}
+
+// newUpstreamTransport creates the transport of HTTP upstreams.
+func newUpstreamTransport(cfg UpstreamConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.KeepAlive}).DialContext
+	transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	return transport
+}
+
+// newRateLimitBackend selects the rate limit backend: in-memory buckets per
+// replica by default, or Redis shared by all replicas.
+func newRateLimitBackend(cfg RateLimitConfig) (RateLimitBackend, error) {
+	if cfg.Backend == "redis" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
 		if err != nil {
-			log.Fatalln(err)
-		}
-		log.Println("Starting gRPC server on port 81...")
-		grpcServer := buildGrpcProxyServer(routeChecker)
-		if err = grpcServer.Serve(grpcListener); err != nil {
-			log.Fatalln(err)
+			return nil, fmt.Errorf("ratelimit: %w", err)
 		}
-	default:
-		log.Fatalln("GATEWAY_API_ROUTE_SERVICE [http | grpc]")
+		return NewRedisRateLimitBackend(redis.NewClient(opts), "gateway:ratelimit:"), nil
 	}
+	return NewMemoryRateLimitBackend(), nil
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CertStore serves the certificates of the TLS listeners, picked by SNI,
+// and reloads them when their files change. Connections in progress keep
+// the certificates they were opened with.
+type CertStore struct {
+	cfg TLSConfig
+
+	config atomic.Pointer[tls.Config]
+
+	mu sync.Mutex
+	// stamps are the sizes and modification times of the loaded files.
+	stamps string
+}
+
+// NewCertStore loads the certificates and client CA of cfg, and checks
+// them for changes every cfg.ReloadInterval.
+func NewCertStore(cfg TLSConfig) (*CertStore, error) {
+	s := &CertStore{cfg: cfg}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	if cfg.ReloadInterval > 0 {
+		go s.watch()
+	}
+	return s, nil
+}
+
+// Config returns the TLS settings of the listeners. Every handshake uses
+// the latest loaded certificates.
+func (s *CertStore) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.config.Load(), nil
+		},
+	}
+}
+
+// Reload loads the files again, keeping the current certificates when any
+// of them is invalid.
+func (s *CertStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stamps, err := s.fileStamps()
+	if err != nil {
+		return err
+	}
+
+	certs := make([]tls.Certificate, 0, len(s.cfg.Certificates))
+	for _, pair := range s.cfg.Certificates {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return fmt.Errorf("tls: %s: %w", pair.Cert, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("tls: %s: %w", pair.Cert, err)
+		}
+		certs = append(certs, cert)
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return selectCertificate(certs, hello), nil
+		},
+	}
+	if s.cfg.ClientCA != "" {
+		data, err := os.ReadFile(s.cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("tls: %s: no certificate found", s.cfg.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.cfg.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	s.config.Store(config)
+	s.stamps = stamps
+	zap.S().Infow("tls", "certificates", len(certs), "client_ca", s.cfg.ClientCA != "")
+	return nil
+}
+
+// watch reloads the files whenever their size or modification time change.
+func (s *CertStore) watch() {
+	ticker := time.NewTicker(s.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		stamps, err := s.fileStamps()
+		s.mu.Lock()
+		changed := err == nil && stamps != s.stamps
+		s.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := s.Reload(); err != nil {
+			zap.S().Errorw(fmt.Sprintf("tls: reload failed | %s", err))
+		}
+	}
+}
+
+func (s *CertStore) fileStamps() (string, error) {
+	files := []string{s.cfg.ClientCA}
+	for _, pair := range s.cfg.Certificates {
+		files = append(files, pair.Cert, pair.Key)
+	}
+	var stamps string
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", fmt.Errorf("tls: %w", err)
+		}
+		stamps += fmt.Sprintf("%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return stamps, nil
+}
+
+// selectCertificate returns the first certificate valid for the server name
+// the client asked for, or else the first one.
+func selectCertificate(certs []tls.Certificate, hello *tls.ClientHelloInfo) *tls.Certificate {
+	for i := range certs {
+		if hello.ServerName != "" && certs[i].Leaf.VerifyHostname(hello.ServerName) == nil {
+			return &certs[i]
+		}
+	}
+	return &certs[0]
+}
+
+// clientCertProject reports whether the verified client certificate of a
+// connection, if any, was issued to project: its common name or one of its
+// DNS names is the project id.
+func clientCertProject(state *tls.ConnectionState, project string) bool {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return false
+	}
+	leaf := state.VerifiedChains[0][0]
+	if leaf.Subject.CommonName == project {
+		return true
+	}
+	for _, name := range leaf.DNSNames {
+		if name == project {
+			return true
+		}
+	}
+	return false
+}
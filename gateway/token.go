@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// Key algorithms projects may sign access tokens with.
+var tokenAlgs = []string{"RS256", "ES256", "EdDSA"}
+
+// RouteKey is a public key, PEM encoded, that a project signs access tokens
+// with. Keys are selected by the kid header of tokens.
+type RouteKey struct {
+	Kid       string `json:"kid"`
+	Alg       string `json:"alg"`
+	PublicKey string `json:"public_key"`
+}
+
+// TokenClaims are the claims of a project access token. Tokens must expire;
+// Chains and Methods, when set, restrict the chains and JSON-RPC methods the
+// token may be used for.
+type TokenClaims struct {
+	Chains  []string `json:"chains,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type projectKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// parseKeys decodes the public keys of a route once, after its lookup.
+func (a *RouteAuth) parseKeys() {
+	a.publicKeys = make(map[string]projectKey, len(a.Keys))
+	for _, k := range a.Keys {
+		key, err := parsePublicKey(k.Alg, []byte(k.PublicKey))
+		if err != nil {
+			zap.S().Errorw(fmt.Sprintf("token: couldn't parse key %s | %s", k.Kid, err))
+			continue
+		}
+		a.publicKeys[k.Kid] = projectKey{alg: k.Alg, key: key}
+	}
+}
+
+func parsePublicKey(alg string, data []byte) (crypto.PublicKey, error) {
+	switch alg {
+	case "RS256":
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	case "ES256":
+		return jwt.ParseECPublicKeyFromPEM(data)
+	case "EdDSA":
+		return jwt.ParseEdPublicKeyFromPEM(data)
+	}
+	return nil, fmt.Errorf("unsupported alg %s", alg)
+}
+
+// VerifyToken checks that token has been signed by one of the project's keys,
+// hasn't expired and may be used for chain.
+func (a RouteAuth) VerifyToken(token, chain, project string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := a.publicKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		if t.Method.Alg() != key.alg {
+			return nil, fmt.Errorf("unexpected alg %s", t.Method.Alg())
+		}
+		return key.key, nil
+	}, jwt.WithValidMethods(tokenAlgs))
+	if err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if claims.Subject != "" && claims.Subject != project {
+		return nil, errors.New("token is for another project")
+	}
+	if len(claims.Chains) > 0 && !containsString(claims.Chains, chain) {
+		return nil, errors.New("token isn't valid for this chain")
+	}
+	return claims, nil
+}
+
+// Expired reports whether the token has expired since it was verified, as
+// happens to long-lived WebSocket connections.
+func (c *TokenClaims) Expired() bool {
+	return c != nil && c.ExpiresAt != nil && time.Now().After(c.ExpiresAt.Time)
+}
+
+// MethodAllowed reports whether the token may call method.
+func (c *TokenClaims) MethodAllowed(method string) bool {
+	return c == nil || len(c.Methods) == 0 || matchAnyMethod(c.Methods, method)
+}
+
+// accessToken returns the bearer token of a request, or the token query
+// parameter that browsers have to use for WebSocket connections.
+func accessToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return req.URL.Query().Get("token")
+}
+
+// stripAccessToken keeps the token from being forwarded to upstreams.
+func stripAccessToken(req *http.Request) {
+	if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		req.Header.Del("Authorization")
+	}
+	if query := req.URL.Query(); query.Has("token") {
+		query.Del("token")
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeys signs tokens with an ES256 key, kid "es", and an EdDSA key, kid
+// "ed", both registered by the returned RouteAuth.
+type testKeys struct {
+	es *ecdsa.PrivateKey
+	ed ed25519.PrivateKey
+}
+
+func newTestAuth(t *testing.T) (RouteAuth, testKeys) {
+	t.Helper()
+	es, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := RouteAuth{Keys: []RouteKey{
+		{Kid: "es", Alg: "ES256", PublicKey: publicKeyPEM(t, &es.PublicKey)},
+		{Kid: "ed", Alg: "EdDSA", PublicKey: publicKeyPEM(t, edPublic)},
+	}}
+	auth.parseKeys()
+	return auth, testKeys{es: es, ed: ed}
+}
+
+func publicKeyPEM(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func (k testKeys) sign(t *testing.T, method jwt.SigningMethod, kid string, claims *TokenClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	var key interface{} = k.es
+	if method == jwt.SigningMethodEdDSA {
+		key = k.ed
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func unsignedToken(t *testing.T, claims *TokenClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	token.Header["kid"] = "es"
+	signed, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func expiring(d time.Duration) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(d))}
+}
+
+func TestVerifyToken(t *testing.T) {
+	auth, keys := newTestAuth(t)
+	withSubject := expiring(time.Hour)
+	withSubject.Subject = "p"
+	otherSubject := expiring(time.Hour)
+	otherSubject.Subject = "q"
+
+	for _, test := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"es256", keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{RegisteredClaims: expiring(time.Hour)}), true},
+		{"eddsa", keys.sign(t, jwt.SigningMethodEdDSA, "ed", &TokenClaims{RegisteredClaims: expiring(time.Hour)}), true},
+		{"subject", keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{RegisteredClaims: withSubject}), true},
+		{"other subject", keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{RegisteredClaims: otherSubject}), false},
+		{"unknown kid", keys.sign(t, jwt.SigningMethodES256, "rsa", &TokenClaims{RegisteredClaims: expiring(time.Hour)}), false},
+		{"kid of another key", keys.sign(t, jwt.SigningMethodEdDSA, "es", &TokenClaims{RegisteredClaims: expiring(time.Hour)}), false},
+		{"alg of another key", keys.sign(t, jwt.SigningMethodES256, "ed", &TokenClaims{RegisteredClaims: expiring(time.Hour)}), false},
+		{"no exp", keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{}), false},
+		{"expired", keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{RegisteredClaims: expiring(-time.Minute)}), false},
+		{"chain allowed", keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{Chains: []string{"a", "c"}, RegisteredClaims: expiring(time.Hour)}), true},
+		{"chain not allowed", keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{Chains: []string{"a"}, RegisteredClaims: expiring(time.Hour)}), false},
+		{"unsigned", unsignedToken(t, &TokenClaims{RegisteredClaims: expiring(time.Hour)}), false},
+	} {
+		_, err := auth.VerifyToken(test.token, "c", "p")
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestTokenMethods(t *testing.T) {
+	auth, keys := newTestAuth(t)
+	token := keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{
+		Methods:          []string{"chain_*", "state_getStorage"},
+		RegisteredClaims: expiring(time.Hour),
+	})
+	claims, err := auth.VerifyToken(token, "c", "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, allowed := range map[string]bool{
+		"chain_getBlock":    true,
+		"state_getStorage":  true,
+		"state_getKeys":     false,
+		"author_rotateKeys": false,
+	} {
+		if claims.MethodAllowed(method) != allowed {
+			t.Errorf("%s: got allowed %v, want %v", method, !allowed, allowed)
+		}
+	}
+	if unrestricted := (*TokenClaims)(nil); !unrestricted.MethodAllowed("author_rotateKeys") {
+		t.Errorf("requests without token: method denied")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth, keys := newTestAuth(t)
+	token := keys.sign(t, jwt.SigningMethodES256, "es", &TokenClaims{RegisteredClaims: expiring(time.Hour)})
+	sum := sha256.Sum256([]byte("s3cret"))
+	withSecret := auth
+	withSecret.SecretHash = hex.EncodeToString(sum[:])
+
+	for _, test := range []struct {
+		name          string
+		auth          RouteAuth
+		secret, token string
+		ok            bool
+	}{
+		{"open project", RouteAuth{}, "", "", true},
+		{"required secret missing", RouteAuth{RequireSecret: true, SecretHash: withSecret.SecretHash}, "", "", false},
+		{"required secret", RouteAuth{RequireSecret: true, SecretHash: withSecret.SecretHash}, "s3cret", "", true},
+		// Keys require credentials even without require_secret.
+		{"keys without credentials", auth, "", "", false},
+		{"keys with token", auth, "", token, true},
+		{"keys with invalid token", auth, "", token + "x", false},
+		{"keys with secret", withSecret, "s3cret", "", true},
+		{"keys with wrong secret", withSecret, "other", "", false},
+	} {
+		_, err := test.auth.authenticate(test.secret, test.token, "c", "p")
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Load balancing strategies a chain may select through its route.
+const (
+	RoundRobin   = "round_robin"
+	LeastRequest = "least_request"
+	Weighted     = "weighted"
+)
+
+type upstreamKey struct{}
+
+// DefaultTransport sends the HTTP requests of every upstream pool.
+var DefaultTransport http.RoundTripper = http.DefaultTransport
+
+// Upstream is a single node serving one protocol of a chain.
+type Upstream struct {
+	// Target is the address as configured in the API, a URL for HTTP and
+	// WebSocket upstreams or a host:port pair for gRPC ones.
+	Target string
+	URL    *url.URL
+	Weight int
+
+	outstanding int64
+	unhealthy   int32
+	current     int // smooth weighted round-robin state, guarded by the pool
+	breaker     *CircuitBreaker
+}
+
+// Healthy reports whether the upstream passed its latest health checks.
+func (u *Upstream) Healthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+func (u *Upstream) setHealthy(healthy bool) bool {
+	if healthy {
+		return atomic.CompareAndSwapInt32(&u.unhealthy, 1, 0)
+	}
+	return atomic.CompareAndSwapInt32(&u.unhealthy, 0, 1)
+}
+
+// acquire counts a request sent to the upstream until the returned function
+// is called, which must happen whether or not its outcome was reported.
+func (u *Upstream) acquire() (release func()) {
+	atomic.AddInt64(&u.outstanding, 1)
+	done := u.breaker.start()
+	return func() {
+		atomic.AddInt64(&u.outstanding, -1)
+		done()
+	}
+}
+
+// Report feeds the outcome of a request into the upstream's circuit breaker.
+func (u *Upstream) Report(failed bool, latency time.Duration) {
+	u.breaker.Record(failed, latency)
+}
+
+// Available reports whether the upstream is healthy and its circuit breaker
+// lets requests through.
+func (u *Upstream) Available() bool {
+	return u.Healthy() && u.breaker.Available()
+}
+
+// Outstanding returns the number of requests currently in flight.
+func (u *Upstream) Outstanding() int64 {
+	return atomic.LoadInt64(&u.outstanding)
+}
+
+// UpstreamPool balances requests for one protocol of a chain across its
+// upstreams.
+type UpstreamPool struct {
+	Strategy  string
+	Upstreams []*Upstream
+
+	mu   sync.Mutex
+	next uint64
+	stop chan struct{}
+}
+
+// NewUpstreamPool builds a pool from the targets returned by the route
+// lookup.
+func NewUpstreamPool(strategy string, targets []UpstreamTarget) *UpstreamPool {
+	pool := &UpstreamPool{Strategy: strategy}
+	for _, target := range targets {
+		if target.URL == "" {
+			continue
+		}
+		u, err := url.Parse(target.URL)
+		if err != nil {
+			// host:port pairs such as 127.0.0.1:9090 aren't valid URLs.
+			zap.S().Debugw("upstream: target is not a url", "target", target.URL, "error", err)
+			u = &url.URL{Host: target.URL}
+		}
+		weight := target.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.Upstreams = append(pool.Upstreams, &Upstream{
+			Target:  target.URL,
+			URL:     u,
+			Weight:  weight,
+			breaker: NewCircuitBreaker(target.URL, DefaultCircuitBreaker),
+		})
+	}
+	return pool
+}
+
+// inherit carries the health and circuit breaker of the upstreams old shares
+// with the pool over, so that replacing a pool doesn't readmit a failing
+// upstream.
+func (p *UpstreamPool) inherit(old *UpstreamPool) {
+	for _, u := range p.Upstreams {
+		for _, o := range old.Upstreams {
+			if u.Target == o.Target {
+				atomic.StoreInt32(&u.unhealthy, atomic.LoadInt32(&o.unhealthy))
+				u.breaker = o.breaker
+				break
+			}
+		}
+	}
+}
+
+// Pick selects an upstream according to the pool's strategy, skipping the
+// excluded ones. It returns nil when no upstream is left.
+func (p *UpstreamPool) Pick(exclude ...*Upstream) *Upstream {
+	if p == nil || len(p.Upstreams) == 0 {
+		return nil
+	}
+
+	candidates := p.available(exclude)
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch p.Strategy {
+	case LeastRequest:
+		return p.leastRequest(candidates)
+	case Weighted:
+		return p.weighted(candidates)
+	default:
+		return p.roundRobin(candidates)
+	}
+}
+
+// available returns the upstreams that may receive traffic. When every
+// upstream is ejected or tripped, all of them are returned: sending requests
+// to a possibly broken node beats failing every request at the gateway.
+// Excluded upstreams are never returned.
+func (p *UpstreamPool) available(exclude []*Upstream) []*Upstream {
+	upstreams := make([]*Upstream, 0, len(p.Upstreams))
+	for _, u := range p.Upstreams {
+		if !containsUpstream(exclude, u) {
+			upstreams = append(upstreams, u)
+		}
+	}
+
+	candidates := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.Available() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return upstreams
+	}
+	return candidates
+}
+
+func containsUpstream(upstreams []*Upstream, u *Upstream) bool {
+	for _, x := range upstreams {
+		if x == u {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UpstreamPool) roundRobin(candidates []*Upstream) *Upstream {
+	n := atomic.AddUint64(&p.next, 1)
+	return candidates[(n-1)%uint64(len(candidates))]
+}
+
+// leastRequest returns the upstream with the fewest requests in flight,
+// starting the scan at a rotating offset so ties are spread evenly.
+func (p *UpstreamPool) leastRequest(candidates []*Upstream) *Upstream {
+	n := atomic.AddUint64(&p.next, 1)
+	var best *Upstream
+	for i := range candidates {
+		u := candidates[(n+uint64(i))%uint64(len(candidates))]
+		if best == nil || u.Outstanding() < best.Outstanding() {
+			best = u
+		}
+	}
+	return best
+}
+
+// weighted implements nginx's smooth weighted round-robin.
+func (p *UpstreamPool) weighted(candidates []*Upstream) *Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	var best *Upstream
+	for _, u := range candidates {
+		u.current += u.Weight
+		total += u.Weight
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func withUpstream(ctx context.Context, u *Upstream) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, u)
+}
+
+func upstreamFromContext(ctx context.Context) *Upstream {
+	u, _ := ctx.Value(upstreamKey{}).(*Upstream)
+	return u
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +22,8 @@ var (
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 
+		// Origins are checked by the Router against the project's
+		// allowlist before upgrading.
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
@@ -36,6 +38,10 @@ var (
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024 * 256,
 	}
+
+	// DefaultMaxMessageSize limits the size of client messages, 0 for no
+	// limit.
+	DefaultMaxMessageSize int64
 )
 
 // WebsocketProxy is an HTTP Handler that takes an incoming WebSocket
@@ -46,10 +52,10 @@ type WebsocketProxy struct {
 	// which will be forwarded to another server.
 	Director func(incoming *http.Request, out http.Header)
 
-	// Backend returns the backend URL which the proxy uses to reverse proxy
-	// the incoming WebSocket connection. Request is the initial incoming and
-	// unmodified request.
-	Backend func(*http.Request) *url.URL
+	// Upstreams are the backends the proxy balances incoming WebSocket
+	// connections across. Each connection stays on the upstream picked when
+	// it was opened.
+	Upstreams *UpstreamPool
 
 	// Upgrader specifies the parameters for upgrading a incoming HTTP
 	// connection to a WebSocket connection. If nil, DefaultUpgrader is used.
@@ -58,30 +64,131 @@ type WebsocketProxy struct {
 	//  Dialer contains options for connecting to the backend WebSocket server.
 	//  If nil, DefaultDialer is used.
 	Dialer *websocket.Dialer
+
+	// Admit, if non-nil, is called for every message sent by the client. It
+	// returns the message to forward to the backend, nil to drop it, and an
+	// optional reply sent back to the client.
+	Admit func(req *http.Request, msg []byte) (forward []byte, reply []byte)
+
+	// Filter, if non-nil, may rewrite every message sent by the backend
+	// before it reaches the client.
+	Filter func(req *http.Request, msg []byte) []byte
+
+	// Sessions tracks the open connections. If nil, DefaultSessions is used.
+	Sessions *WebsocketSessions
 }
 
-// NewProxy returns a new Websocket reverse proxy that rewrites the
-// URL's to the scheme, host and base path provider in target.
-func NewWebsocketProxy(target *url.URL) *WebsocketProxy {
-	backend := func(r *http.Request) *url.URL {
-		u := *target
-		return &u
+// WebsocketSessions tracks open WebSocket connections so that clients can be
+// told to reconnect when the gateway shuts down.
+type WebsocketSessions struct {
+	mu      sync.Mutex
+	conns   map[*wsConn]struct{}
+	closing bool
+	done    chan struct{} // closed once the last connection ends while closing
+}
+
+// DefaultSessions tracks the connections of every WebsocketProxy without
+// Sessions.
+var DefaultSessions = NewWebsocketSessions()
+
+func NewWebsocketSessions() *WebsocketSessions {
+	return &WebsocketSessions{conns: make(map[*wsConn]struct{}), done: make(chan struct{})}
+}
+
+// add registers a connection, it returns false once the sessions are
+// closing.
+func (s *WebsocketSessions) add(c *wsConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
 	}
-	return &WebsocketProxy{Backend: backend}
+	s.conns[c] = struct{}{}
+	return true
 }
 
-// ServeHTTP implements the http.Handler that proxies WebSocket connections.
-func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if w.Backend == nil {
-		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusInternalServerError)
+func (s *WebsocketSessions) remove(c *wsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	if s.closing && len(s.conns) == 0 {
+		close(s.done)
+	}
+}
+
+// Len returns the number of open connections.
+func (s *WebsocketSessions) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Close sends every client a close frame with code and waits for the
+// sessions to end until ctx is done, then closes the remaining connections.
+// New connections are refused from now on.
+func (s *WebsocketSessions) Close(ctx context.Context, code int, text string) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
 		return
 	}
+	s.closing = true
+	conns := make([]*wsConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	if len(s.conns) == 0 {
+		close(s.done)
+	}
+	s.mu.Unlock()
+
+	msg := websocket.FormatCloseMessage(code, text)
+	deadline := time.Now().Add(time.Second)
+	for _, c := range conns {
+		c.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+	zap.S().Infow("ws", "closing", len(conns), "code", code)
 
-	backendURL := w.Backend(req)
-	if backendURL == nil {
-		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusInternalServerError)
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// wsConn serializes writes to a websocket.Conn, which supports a single
+// concurrent writer only.
+type wsConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// NewWebsocketProxy returns a new Websocket reverse proxy that balances
+// connections across upstreams.
+func NewWebsocketProxy(upstreams *UpstreamPool) *WebsocketProxy {
+	return &WebsocketProxy{Upstreams: upstreams}
+}
+
+// ServeHTTP implements the http.Handler that proxies WebSocket connections.
+func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	upstream := w.Upstreams.Pick()
+	if upstream == nil {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
+	release := upstream.acquire()
+	defer release()
+	backendURL := upstream.URL
 
 	dialer := w.Dialer
 	if w.Dialer == nil {
@@ -141,7 +248,9 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// opening a new TCP connection time for each request. This should be
 	// optional:
 	// http://tools.ietf.org/html/draft-ietf-hybi-websocket-multiplexing-01
+	ts := time.Now()
 	connBackend, resp, err := dialer.Dial(backendURL.String(), requestHeader)
+	upstream.Report(err != nil, time.Since(ts))
 	if err != nil {
 		zap.S().Errorw(fmt.Sprintf("ws: couldn't dial to remote backend url | %s", err))
 		if resp != nil {
@@ -181,10 +290,46 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	defer connPub.Close()
+	if DefaultMaxMessageSize > 0 {
+		connPub.SetReadLimit(DefaultMaxMessageSize)
+	}
+
+	pub, backend := &wsConn{Conn: connPub}, &wsConn{Conn: connBackend}
+
+	sessions := w.Sessions
+	if sessions == nil {
+		sessions = DefaultSessions
+	}
+	if !sessions.add(pub) {
+		pub.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, "service restart"), time.Now().Add(time.Second))
+		return
+	}
+	defer sessions.remove(pub)
+
+	// admit lets the Admit hook answer client messages itself instead of
+	// forwarding them to the backend.
+	admit := func(msg []byte) []byte {
+		if w.Admit == nil {
+			return msg
+		}
+		forward, reply := w.Admit(req, msg)
+		if reply != nil {
+			pub.WriteMessage(websocket.TextMessage, reply)
+		}
+		return forward
+	}
+
+	filter := func(msg []byte) []byte {
+		if w.Filter == nil {
+			return msg
+		}
+		return w.Filter(req, msg)
+	}
 
 	errClient := make(chan error, 1)
 	errBackend := make(chan error, 1)
-	replicateWebsocketConn := func(dst, src *websocket.Conn, errc chan error, logger func(data []byte)) {
+	replicateWebsocketConn := func(dst, src *wsConn, errc chan error, filter func(data []byte) []byte, logger func(data []byte)) {
 		for {
 			msgType, msg, err := src.ReadMessage()
 			if err != nil {
@@ -198,6 +343,9 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				dst.WriteMessage(websocket.CloseMessage, m)
 				break
 			}
+			if msg = filter(msg); msg == nil {
+				continue
+			}
 			err = dst.WriteMessage(msgType, msg)
 			if err != nil {
 				errc <- err
@@ -221,6 +369,10 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		m            map[interface{}]request
 	}{m: make(map[interface{}]request)}
 
+	// subscriptions opened by the client, which end with the connection.
+	// Only counted by logResponse.
+	var subscriptions int
+
 	logRequest := func(data []byte) {
 		var jsonMap map[string]interface{}
 		if err := json.Unmarshal(data, &jsonMap); err != nil {
@@ -247,6 +399,24 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			v, ok := requestCache.m[id]
 			requestCache.RUnlock()
 			if ok {
+				method := jsonRpcMethod(v.Method)
+				status := "ok"
+				if jsonMap["error"] != nil {
+					status = "error"
+				}
+				observeRouted(req.Context(), true, method, status, time.Since(v.Timestamp))
+				if status == "ok" {
+					switch lower := strings.ToLower(method); {
+					case strings.Contains(lower, "unsubscribe"):
+						if subscriptions > 0 {
+							subscriptions--
+							websocketSubscriptions.Dec()
+						}
+					case strings.Contains(lower, "subscribe"):
+						subscriptions++
+						websocketSubscriptions.Inc()
+					}
+				}
 				zap.S().Infow("request",
 					"path", req.URL.Path,
 					"id", v.Id,
@@ -279,8 +449,11 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	go replicateWebsocketConn(connPub, connBackend, errClient, logResponse)
-	go replicateWebsocketConn(connBackend, connPub, errBackend, logRequest)
+	go func() {
+		replicateWebsocketConn(pub, backend, errClient, filter, logResponse)
+		websocketSubscriptions.Sub(float64(subscriptions))
+	}()
+	go replicateWebsocketConn(backend, pub, errBackend, admit, logRequest)
 
 	var message string
 	select {